@@ -0,0 +1,1003 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qeedquan/go-media/x11/xlib"
+	"github.com/qeedquan/go-media/x11/xlib/xk"
+)
+
+// The config file, $XDG_CONFIG_HOME/st/config, overrides the values of
+// config.go at startup. It is written in a subset of TOML: the settings
+// named after the variables of config.go first, then the tables of
+// shortcuts, keys and mouse shortcuts, which go before the built-in ones.
+//
+//	font = "Liberation Mono:pixelsize=14"
+//	colorname = ["black", "red3", "green3"]
+//	color256 = "#cccccc"
+//	blinktimeout = "500ms"
+//
+//	[[shortcut]]
+//	mod = "Control|Shift"
+//	keysym = "K"
+//	action = "kscrollup"
+//	arg = 1
+//
+//	[[key]]
+//	keysym = "BackSpace"
+//	string = "\b"
+//
+//	[[mshortcut]]
+//	button = 4
+//	mod = "Shift"
+//	string = "\e[5;2~"
+//
+// A table without mod matches the key or button with no modifier.
+
+type ConfParser struct {
+	path string
+	s    string
+	pos  int
+	line int
+	errs []error
+}
+
+type ConfEntry struct {
+	key  string
+	val  interface{} // string, int64, float64, bool or []interface{}
+	line int
+}
+
+type ConfTable struct {
+	name    string
+	line    int
+	entries []ConfEntry
+}
+
+type ConfAction struct {
+	fn    func(interface{})
+	arg   interface{}    // default argument, the others are of its type
+	names map[string]int // names of the int arguments
+}
+
+// ConfRate is a count kept in a time.Duration, as xfps
+type ConfRate time.Duration
+
+// ConfEnum is an int set by name
+type ConfEnum struct {
+	p     *int
+	names map[string]int
+}
+
+var confvars = map[string]interface{}{
+	"font":               &font,
+	"borderpx":           &borderpx,
+	"renderfontsize":     &renderfontsize,
+	"vtiden":             &vtiden,
+	"cwscale":            &cwscale,
+	"chscale":            &chscale,
+	"worddelimiters":     &worddelimiters,
+	"snappatterns":       &snappatterns,
+	"snappairs":          &snappairs,
+	"keepselection":      &keepselection,
+	"doubleclicktimeout": &doubleclicktimeout,
+	"tripleclicktimeout": &tripleclicktimeout,
+	"allowaltscreen":     &allowaltscreen,
+	"histsize":           &histsize,
+	"titlestatus":        &titlestatus,
+	"strbufmax":          &strbufmax,
+	"allowosc52read":     &allowosc52read,
+	"osc52maxlen":        &osc52maxlen,
+	"notifycmd":          &notifycmd,
+	"notifyburst":        &notifyburst,
+	"notifyrate":         &notifyrate,
+	"xfps":               (*ConfRate)(&xfps),
+	"actionfps":          (*ConfRate)(&actionfps),
+	"blinktimeout":       &blinktimeout,
+	"cursorthickness":    &cursorthickness,
+	"bellvolume":         &bellvolume,
+	"termname":           &termname,
+	"recordinput":        &recordinput,
+	"tabspaces":          &tabspaces,
+	"defaultfg":          &defaultfg,
+	"defaultbg":          &defaultbg,
+	"defaultcs":          &defaultcs,
+	"defaultrcs":         &defaultrcs,
+	"copymodecs":         &copymodecs,
+	"searchfg":           &searchfg,
+	"searchbg":           &searchbg,
+	"searchcurbg":        &searchcurbg,
+	"cursorshape":        &cursorshape,
+	"cols":               &cols,
+	"rows":               &rows,
+	"mousefg":            &mousefg,
+	"mousebg":            &mousebg,
+	"defaultattr":        &defaultattr,
+	"searchregex":        &searchregex,
+	"searchignorecase":   &searchignorecase,
+	"hintpatterns":       &hintpatterns,
+	"hintalphabet":       &hintalphabet,
+	"hintopen":           &hintopen,
+	"exportdir":          &exportdir,
+	"pastefilter": ConfEnum{&pastefilter, map[string]int{
+		"keep":  PASTE_KEEP,
+		"strip": PASTE_STRIP,
+		"caret": PASTE_CARET,
+	}},
+	"pasteconfirm": &pasteconfirm,
+	"incrtimeout":  &incrtimeout,
+}
+
+// ConfRange bounds an int setting
+type ConfRange struct {
+	min, max int
+}
+
+// the int settings that would hang or break st out of their bounds
+var confranges = map[string]ConfRange{
+	"borderpx":    {0, 1000},
+	"histsize":    {0, 1 << 20},
+	"strbufmax":   {0, 1 << 30},
+	"osc52maxlen": {0, 1 << 30},
+	"notifyburst": {0, 1000},
+	"xfps":        {1, 1000},
+	"actionfps":   {1, 1000},
+	"bellvolume":  {-100, 100},
+	"tabspaces":   {1, 255},
+	"cols":        {1, 1000},
+	"rows":        {1, 1000},
+}
+
+// the float settings, above min and up to max
+var conffranges = map[string]struct{ min, max float64 }{
+	"cwscale":        {0, 10},
+	"chscale":        {0, 10},
+	"renderfontsize": {0, 1000},
+}
+
+// the settings that are indexes of colorname
+var confcolors = map[string]bool{
+	"defaultfg":   true,
+	"defaultbg":   true,
+	"defaultcs":   true,
+	"defaultrcs":  true,
+	"defaultattr": true,
+	"copymodecs":  true,
+	"searchfg":    true,
+	"searchbg":    true,
+	"searchcurbg": true,
+	"mousefg":     true,
+	"mousebg":     true,
+}
+
+var confactions = map[string]ConfAction{
+	"sendbreak":     {fn: sendbreak, arg: 0},
+	"toggleprinter": {fn: toggleprinter, arg: 0},
+	"printscreen":   {fn: printscreen, arg: 0},
+	"printsel":      {fn: printsel, arg: 0},
+	"zoom":          {fn: zoom, arg: +1.0},
+	"zoomreset":     {fn: zoomreset, arg: 0.0},
+	"clipcopy":      {fn: clipcopy, arg: 0},
+	"clippaste":     {fn: clippaste, arg: 0},
+	"selpaste":      {fn: selpaste, arg: 0},
+	"numlock":       {fn: numlock, arg: 0},
+	"kscrollup":     {fn: kscrollup, arg: -1},
+	"kscrolldown":   {fn: kscrolldown, arg: -1},
+	"kscrollprompt": {fn: kscrollprompt, arg: -1},
+	"copycmdoutput": {fn: copycmdoutput, arg: 0},
+	"newterm":       {fn: newterm, arg: 0},
+	"copymodestart": {fn: copymodestart, arg: 0},
+	"searchstart":   {fn: searchstart, arg: +1},
+	"hintstart": {fn: hintstart, arg: HINT_OPEN, names: map[string]int{
+		"open":  HINT_OPEN,
+		"copy":  HINT_COPY,
+		"paste": HINT_PASTE,
+	}},
+	"externalpipe": {fn: externalpipe, arg: ExternalPipe{}},
+	"export":       {fn: export, arg: Export{}},
+	"playpause":    {fn: playpause, arg: 0},
+	"playstep":     {fn: playstep, arg: 0},
+	"playspeed":    {fn: playspeed, arg: 2.0},
+	"playskip":     {fn: playskip, arg: +5.0},
+}
+
+var confexportformats = map[string]int{
+	"html": EXPORT_HTML,
+	"svg":  EXPORT_SVG,
+	"ansi": EXPORT_ANSI,
+}
+
+var confmods = map[string]uint{
+	"none":    XK_NO_MOD,
+	"any":     XK_ANY_MOD,
+	"shift":   xlib.ShiftMask,
+	"control": xlib.ControlMask,
+	"ctrl":    xlib.ControlMask,
+	"mod1":    xlib.Mod1Mask,
+	"alt":     xlib.Mod1Mask,
+	"mod2":    xlib.Mod2Mask,
+	"mod3":    xlib.Mod3Mask,
+	"mod4":    xlib.Mod4Mask,
+	"super":   xlib.Mod4Mask,
+	"mod5":    xlib.Mod5Mask,
+	"termmod": TERMMOD,
+	"modkey":  MODKEY,
+}
+
+// the keysyms with a name, a single char is its own keysym
+var confkeysyms = map[string]xlib.KeySym{
+	"BackSpace":    xk.BackSpace,
+	"Tab":          xk.Tab,
+	"ISO_Left_Tab": xk.ISO_Left_Tab,
+	"Return":       xk.Return,
+	"Escape":       xk.Escape,
+	"Break":        xk.Break,
+	"Print":        xk.Print,
+	"Num_Lock":     xk.Num_Lock,
+	"Insert":       xk.Insert,
+	"Delete":       xk.Delete,
+	"Home":         xk.Home,
+	"End":          xk.End,
+	"Prior":        xk.Prior,
+	"Page_Up":      xk.Prior,
+	"Next":         xk.Next,
+	"Page_Down":    xk.Next,
+	"Up":           xk.Up,
+	"Down":         xk.Down,
+	"Left":         xk.Left,
+	"Right":        xk.Right,
+	"F1":           xk.F1,
+	"F2":           xk.F2,
+	"F3":           xk.F3,
+	"F4":           xk.F4,
+	"F5":           xk.F5,
+	"F6":           xk.F6,
+	"F7":           xk.F7,
+	"F8":           xk.F8,
+	"F9":           xk.F9,
+	"F10":          xk.F10,
+	"F11":          xk.F11,
+	"F12":          xk.F12,
+	"F13":          xk.F13,
+	"F14":          xk.F14,
+	"F15":          xk.F15,
+	"F16":          xk.F16,
+	"F17":          xk.F17,
+	"F18":          xk.F18,
+	"F19":          xk.F19,
+	"F20":          xk.F20,
+	"F21":          xk.F21,
+	"F22":          xk.F22,
+	"F23":          xk.F23,
+	"F24":          xk.F24,
+	"F25":          xk.F25,
+	"F26":          xk.F26,
+	"F27":          xk.F27,
+	"F28":          xk.F28,
+	"F29":          xk.F29,
+	"F30":          xk.F30,
+	"F31":          xk.F31,
+	"F32":          xk.F32,
+	"F33":          xk.F33,
+	"F34":          xk.F34,
+	"F35":          xk.F35,
+	"KP_Home":      xk.KP_Home,
+	"KP_Up":        xk.KP_Up,
+	"KP_Down":      xk.KP_Down,
+	"KP_Left":      xk.KP_Left,
+	"KP_Right":     xk.KP_Right,
+	"KP_Prior":     xk.KP_Prior,
+	"KP_Next":      xk.KP_Next,
+	"KP_Begin":     xk.KP_Begin,
+	"KP_End":       xk.KP_End,
+	"KP_Insert":    xk.KP_Insert,
+	"KP_Delete":    xk.KP_Delete,
+	"KP_Multiply":  xk.KP_Multiply,
+	"KP_Add":       xk.KP_Add,
+	"KP_Enter":     xk.KP_Enter,
+	"KP_Subtract":  xk.KP_Subtract,
+	"KP_Decimal":   xk.KP_Decimal,
+	"KP_Divide":    xk.KP_Divide,
+	"KP_0":         xk.KP_0,
+	"KP_1":         xk.KP_1,
+	"KP_2":         xk.KP_2,
+	"KP_3":         xk.KP_3,
+	"KP_4":         xk.KP_4,
+	"KP_5":         xk.KP_5,
+	"KP_6":         xk.KP_6,
+	"KP_7":         xk.KP_7,
+	"KP_8":         xk.KP_8,
+	"KP_9":         xk.KP_9,
+}
+
+// confload reads the config file if there is one
+func confload() {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	path := filepath.Join(dir, "st", "config")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		}
+		return
+	}
+	for _, err := range confparse(path, string(b)) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// confparse applies the config file read from path and returns its
+// errors, the settings and tables with one are left out
+func confparse(path, s string) []error {
+	p := &ConfParser{path: path, s: s, line: 1}
+	var tables []ConfTable
+	for {
+		confspace(p, true)
+		if p.pos >= len(p.s) {
+			break
+		}
+
+		line := p.line
+		rest := p.s[p.pos:]
+		if strings.HasPrefix(rest, "[") {
+			end := strings.IndexAny(rest, "]\n")
+			if !strings.HasPrefix(rest, "[[") || end < 0 || !strings.HasPrefix(rest[end:], "]]") {
+				conferror(p, line, "only arrays of tables are supported, as [[shortcut]]")
+				confskipline(p)
+				continue
+			}
+			tables = append(tables, ConfTable{name: strings.TrimSpace(rest[2:end]), line: line})
+			p.pos += end + 2
+			if err := confeol(p); err != nil {
+				conferror(p, line, "%v", err)
+				confskipline(p)
+			}
+			continue
+		}
+
+		e, err := confentry(p)
+		if err != nil {
+			conferror(p, p.line, "%v", err)
+			confskipline(p)
+			continue
+		}
+		if len(tables) > 0 {
+			t := &tables[len(tables)-1]
+			t.entries = append(t.entries, e)
+		} else {
+			confset(p, e)
+		}
+	}
+
+	var sc, psc []Shortcut
+	var keys []Key
+	var ms []MouseShortcut
+	for _, t := range tables {
+		switch t.name {
+		case "shortcut", "playshortcut":
+			s, ok := confshortcut(p, t)
+			if ok && t.name == "shortcut" {
+				sc = append(sc, s)
+			} else if ok {
+				psc = append(psc, s)
+			}
+		case "key":
+			if k, ok := confkey(p, t); ok {
+				keys = append(keys, k)
+			}
+		case "mshortcut":
+			if m, ok := confmshortcut(p, t); ok {
+				ms = append(ms, m)
+			}
+		default:
+			conferror(p, t.line, "unknown table [[%s]]", t.name)
+		}
+	}
+	shortcuts = append(sc, shortcuts...)
+	playshortcuts = append(psc, playshortcuts...)
+	key = append(keys, key...)
+	mshortcuts = append(ms, mshortcuts...)
+	return p.errs
+}
+
+func conferror(p *ConfParser, line int, format string, args ...interface{}) {
+	p.errs = append(p.errs, fmt.Errorf("%s:%d: %s", p.path, line, fmt.Sprintf(format, args...)))
+}
+
+// confspace skips the blanks and the comments, and the line ends if nl
+func confspace(p *ConfParser, nl bool) {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\r':
+		case '\n':
+			if !nl {
+				return
+			}
+			p.line++
+		case '#':
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+// confeol reads the end of the line
+func confeol(p *ConfParser) error {
+	confspace(p, false)
+	if p.pos < len(p.s) && p.s[p.pos] != '\n' {
+		rest := p.s[p.pos:]
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			rest = rest[:i]
+		}
+		return fmt.Errorf("unexpected %q at the end of the line", rest)
+	}
+	return nil
+}
+
+func confskipline(p *ConfParser) {
+	for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+		p.pos++
+	}
+}
+
+// confentry reads a key = value line
+func confentry(p *ConfParser) (ConfEntry, error) {
+	e := ConfEntry{line: p.line}
+	n := strings.IndexFunc(p.s[p.pos:], func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '-')
+	})
+	if n < 0 {
+		n = len(p.s) - p.pos
+	}
+	if n == 0 {
+		return e, fmt.Errorf("expected a key")
+	}
+	e.key = p.s[p.pos : p.pos+n]
+	p.pos += n
+
+	confspace(p, false)
+	if p.pos >= len(p.s) || p.s[p.pos] != '=' {
+		return e, fmt.Errorf("expected = after %s", e.key)
+	}
+	p.pos++
+	confspace(p, false)
+
+	var err error
+	if e.val, err = confvalue(p); err != nil {
+		return e, err
+	}
+	return e, confeol(p)
+}
+
+func confvalue(p *ConfParser) (interface{}, error) {
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("expected a value")
+	}
+	switch c := p.s[p.pos]; {
+	case c == '"' || c == '\'':
+		return confstr(p)
+	case c == '[':
+		p.pos++
+		var a []interface{}
+		for {
+			confspace(p, true)
+			if p.pos < len(p.s) && p.s[p.pos] == ']' {
+				p.pos++
+				return a, nil
+			}
+			v, err := confvalue(p)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+			confspace(p, true)
+			if p.pos < len(p.s) && p.s[p.pos] == ',' {
+				p.pos++
+			} else if p.pos >= len(p.s) || p.s[p.pos] != ']' {
+				return nil, fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	n := strings.IndexAny(p.s[p.pos:], " \t\r\n#,]")
+	if n < 0 {
+		n = len(p.s) - p.pos
+	}
+	tok := p.s[p.pos : p.pos+n]
+	p.pos += n
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	num := strings.ReplaceAll(tok, "_", "")
+	if i, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("bad value %q", tok)
+}
+
+// confstr reads a basic string, with escapes, or a literal one
+func confstr(p *ConfParser) (string, error) {
+	const escapes, escaped = "btnfre\"\\", "\b\t\n\f\r\033\"\\"
+
+	q := p.s[p.pos]
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == q:
+			return b.String(), nil
+		case c == '\\' && q == '"' && p.pos < len(p.s):
+			c = p.s[p.pos]
+			p.pos++
+			if i := strings.IndexByte(escapes, c); i >= 0 {
+				b.WriteByte(escaped[i])
+				continue
+			}
+			n := 4
+			if c == 'U' {
+				n = 8
+			} else if c != 'u' {
+				return "", fmt.Errorf("bad escape \\%c", c)
+			}
+			if p.pos+n > len(p.s) {
+				return "", fmt.Errorf("bad escape \\%c", c)
+			}
+			r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("bad escape \\%c%s", c, p.s[p.pos:p.pos+n])
+			}
+			b.WriteRune(rune(r))
+			p.pos += n
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func confstring(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("want a string")
+	}
+	return s, nil
+}
+
+func confint(v interface{}) (int, error) {
+	i, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("want an integer")
+	}
+	return int(i), nil
+}
+
+func conffloat(v interface{}) (float64, error) {
+	switch f := v.(type) {
+	case int64:
+		return float64(f), nil
+	case float64:
+		return f, nil
+	}
+	return 0, fmt.Errorf("want a number")
+}
+
+func confbool(v interface{}) (bool, error) {
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("want true or false")
+	}
+	return b, nil
+}
+
+func confstrings(v interface{}) ([]string, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("want an array of strings")
+	}
+	l := make([]string, len(a))
+	for i := range a {
+		if l[i], ok = a[i].(string); !ok {
+			return nil, fmt.Errorf("want an array of strings")
+		}
+	}
+	return l, nil
+}
+
+// confset sets a variable of config.go, colorN sets a single color and
+// colorname the first ones
+func confset(p *ConfParser, e ConfEntry) {
+	if n, err := strconv.Atoi(strings.TrimPrefix(e.key, "color")); err == nil && e.key != "color" && n >= 0 && n < 1<<16 {
+		s, err := confstring(e.val)
+		if err != nil {
+			conferror(p, e.line, "%s: %v", e.key, err)
+			return
+		}
+		for len(colorname) <= n {
+			colorname = append(colorname, "")
+		}
+		colorname[n] = s
+		return
+	}
+
+	if e.key == "colorname" {
+		// the first colors, the others are kept
+		l, err := confstrings(e.val)
+		if err != nil {
+			conferror(p, e.line, "%s: %v", e.key, err)
+			return
+		}
+		for len(colorname) < len(l) {
+			colorname = append(colorname, "")
+		}
+		copy(colorname, l)
+		return
+	}
+
+	if _, ok := confvars[e.key]; !ok {
+		conferror(p, e.line, "unknown setting %s", e.key)
+		return
+	}
+	if err := confvarset(e.key, e.val); err != nil {
+		conferror(p, e.line, "%s: %v", e.key, err)
+	}
+}
+
+// confvarset sets the setting name of confvars, within its bounds
+func confvarset(name string, v interface{}) error {
+	if r, ok := confranges[name]; ok {
+		if i, err := confint(v); err == nil && (i < r.min || i > r.max) {
+			return fmt.Errorf("want a value from %d to %d", r.min, r.max)
+		}
+	}
+	if r, ok := conffranges[name]; ok {
+		if f, err := conffloat(v); err == nil && (f <= r.min || f > r.max) {
+			return fmt.Errorf("want a value above %g up to %g", r.min, r.max)
+		}
+	}
+	if confcolors[name] {
+		// they index the loaded colors, a true color would be past them
+		n := max(len(colorname), 256)
+		if i, err := confint(v); err == nil && (i < 0 || i >= n) {
+			return fmt.Errorf("want a color index below %d", n)
+		}
+	}
+	if s, ok := v.(string); ok && name == "hintalphabet" {
+		seen := map[rune]bool{}
+		for _, r := range s {
+			if seen[r] {
+				return fmt.Errorf("%q is twice in the alphabet", r)
+			}
+			seen[r] = true
+		}
+		if len(seen) < 2 {
+			return fmt.Errorf("want at least 2 chars")
+		}
+	}
+	return confassign(confvars[name], v)
+}
+
+// confassign sets the variable dst points to, it is left as it was on
+// errors
+func confassign(dst, v interface{}) error {
+	switch d := dst.(type) {
+	case *string:
+		s, err := confstring(v)
+		if err != nil {
+			return err
+		}
+		*d = s
+	case *[]rune:
+		s, err := confstring(v)
+		if err != nil {
+			return err
+		}
+		*d = []rune(s)
+	case *[]byte:
+		s, err := confstring(v)
+		if err != nil {
+			return err
+		}
+		*d = []byte(s)
+	case *[]string:
+		l, err := confstrings(v)
+		if err != nil {
+			return err
+		}
+		*d = l
+	case *bool:
+		b, err := confbool(v)
+		if err != nil {
+			return err
+		}
+		*d = b
+	case *int:
+		i, err := confint(v)
+		if err != nil {
+			return err
+		}
+		*d = i
+	case *uint32:
+		i, err := confint(v)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return fmt.Errorf("want a color index")
+		}
+		*d = uint32(i)
+	case *float64:
+		f, err := conffloat(v)
+		if err != nil {
+			return err
+		}
+		*d = f
+	case *time.Duration:
+		s, err := confstring(v)
+		if err != nil {
+			return fmt.Errorf("want a duration such as \"500ms\"")
+		}
+		t, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = t
+	case *ConfRate:
+		i, err := confint(v)
+		if err != nil {
+			return err
+		}
+		*d = ConfRate(i)
+	case ConfEnum:
+		s, err := confstring(v)
+		if err != nil {
+			return err
+		}
+		n, ok := d.names[s]
+		if !ok {
+			return fmt.Errorf("unknown value %q", s)
+		}
+		*d.p = n
+	}
+	return nil
+}
+
+// confmod reads modifiers such as "Control|Shift"
+func confmod(v interface{}) (uint, error) {
+	s, err := confstring(v)
+	if err != nil {
+		return 0, err
+	}
+	var mod uint
+	for _, m := range strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == '+' }) {
+		m = strings.TrimSpace(m)
+		n, ok := confmods[strings.ToLower(m)]
+		if !ok {
+			return 0, fmt.Errorf("unknown modifier %q", m)
+		}
+		mod |= n
+	}
+	return mod, nil
+}
+
+func confkeysym(v interface{}) (xlib.KeySym, error) {
+	s, err := confstring(v)
+	if err != nil {
+		return 0, err
+	}
+	if k, ok := confkeysyms[s]; ok {
+		return k, nil
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	switch {
+	case n == 0 || n != len(s) || r == utf8.RuneError:
+		return 0, fmt.Errorf("unknown keysym %q", s)
+	case r < 0x100:
+		// Latin-1 keysyms are their code
+		return xlib.KeySym(r), nil
+	}
+	return xlib.KeySym(0x01000000 | r), nil
+}
+
+// confarg sets the part of the argument of action a given by e
+func confarg(a ConfAction, arg interface{}, e ConfEntry) (interface{}, error) {
+	var err error
+	switch x := arg.(type) {
+	case int:
+		if e.key != "arg" {
+			break
+		}
+		if s, ok := e.val.(string); ok && a.names != nil {
+			n, ok := a.names[s]
+			if !ok {
+				return arg, fmt.Errorf("unknown argument %q", s)
+			}
+			return n, nil
+		}
+		return confint(e.val)
+	case float64:
+		if e.key == "arg" {
+			return conffloat(e.val)
+		}
+	case ExternalPipe:
+		switch e.key {
+		case "command":
+			x.cmd, err = confstrings(e.val)
+			return x, err
+		case "history":
+			x.hist, err = confbool(e.val)
+			return x, err
+		case "reply":
+			x.reply, err = confbool(e.val)
+			return x, err
+		}
+	case Export:
+		switch e.key {
+		case "format":
+			var s string
+			if s, err = confstring(e.val); err != nil {
+				return x, err
+			}
+			n, ok := confexportformats[s]
+			if !ok {
+				return x, fmt.Errorf("unknown format %q", s)
+			}
+			x.format = n
+			return x, nil
+		case "selection":
+			x.sel, err = confbool(e.val)
+			return x, err
+		case "clipboard":
+			x.clip, err = confbool(e.val)
+			return x, err
+		}
+	}
+	return arg, fmt.Errorf("unknown key")
+}
+
+func confshortcut(p *ConfParser, t ConfTable) (Shortcut, bool) {
+	s := Shortcut{mod: XK_NO_MOD}
+	ok, haskey := true, false
+	fail := func(e ConfEntry, err error) {
+		conferror(p, e.line, "%s: %v", e.key, err)
+		ok = false
+	}
+
+	// the action first, the other keys depend on it
+	var a ConfAction
+	for _, e := range t.entries {
+		if e.key != "action" {
+			continue
+		}
+		name, err := confstring(e.val)
+		if err == nil {
+			var found bool
+			if a, found = confactions[name]; !found {
+				err = fmt.Errorf("unknown action %q", name)
+			}
+		}
+		if err != nil {
+			fail(e, err)
+		}
+	}
+	if a.fn == nil {
+		if ok {
+			conferror(p, t.line, "[[%s]] without an action", t.name)
+		}
+		return s, false
+	}
+	s.funct, s.arg = a.fn, a.arg
+
+	for _, e := range t.entries {
+		var err error
+		switch e.key {
+		case "action":
+		case "keysym":
+			s.keysym, err = confkeysym(e.val)
+			haskey = true
+		case "mod":
+			s.mod, err = confmod(e.val)
+		default:
+			s.arg, err = confarg(a, s.arg, e)
+		}
+		if err != nil {
+			fail(e, err)
+		}
+	}
+	if !haskey {
+		conferror(p, t.line, "[[%s]] without a keysym", t.name)
+		return s, false
+	}
+	return s, ok
+}
+
+func confkey(p *ConfParser, t ConfTable) (Key, bool) {
+	k := Key{mask: XK_NO_MOD}
+	ok, haskey := true, false
+	for _, e := range t.entries {
+		var err error
+		switch e.key {
+		case "keysym":
+			k.k, err = confkeysym(e.val)
+			haskey = true
+		case "mod":
+			k.mask, err = confmod(e.val)
+		case "string":
+			k.s, err = confstring(e.val)
+		case "appkey":
+			k.appkey, err = confint(e.val)
+		case "appcursor":
+			k.appcursor, err = confint(e.val)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			conferror(p, e.line, "%s: %v", e.key, err)
+			ok = false
+		}
+	}
+	if !haskey {
+		conferror(p, t.line, "[[key]] without a keysym")
+		return k, false
+	}
+	return k, ok
+}
+
+func confmshortcut(p *ConfParser, t ConfTable) (MouseShortcut, bool) {
+	m := MouseShortcut{mask: XK_NO_MOD}
+	ok := true
+	for _, e := range t.entries {
+		var err error
+		switch e.key {
+		case "button":
+			// the X button number
+			var n int
+			if n, err = confint(e.val); err == nil && n < 1 {
+				err = fmt.Errorf("want a button number")
+			}
+			m.b = uint(n)
+		case "mod":
+			m.mask, err = confmod(e.val)
+		case "string":
+			m.s, err = confstring(e.val)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			conferror(p, e.line, "%s: %v", e.key, err)
+			ok = false
+		}
+	}
+	if m.b == 0 {
+		if ok {
+			conferror(p, t.line, "[[mshortcut]] without a button")
+		}
+		return m, false
+	}
+	return m, ok
+}
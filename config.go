@@ -15,6 +15,10 @@ const VERSION = "0.8.2"
 var font = "Liberation Mono:pixelsize=12:antialias=true:autohint=true"
 var borderpx = 2
 
+// pixel size of the Go Mono font drawn by -render, which has no
+// fontconfig to look for the font above
+var renderfontsize = 14.0
+
 // What program is execed by st depends of these precedence rules:
 // 1: program passed with -e
 // 2: utmp option
@@ -36,6 +40,24 @@ var chscale = 1.0
 // More advanced example: " `'\"()[]{}"
 var worddelimiters = []rune(" ")
 
+// Double click selects the match of the first of these patterns going
+// through the pointer, before falling back to worddelimiters: URLs,
+// paths and e-mail addresses.
+var snappatterns = []string{
+	`(https?|ftp|file)://[\w\-.~:/?#\[\]@!$&'()*+,;=%]*[\w\-~/#@$&*+=%]`,
+	`(~|\.{1,2}|[\w.\-]+)?/[\w.\-~/]*[\w\-~]`,
+	`[\w.+\-]+@[\w\-]+(\.[\w\-]+)+`,
+}
+
+// Each further click after a double click selects the inside of the next
+// of these pairs around the pointer, then the line.
+var snappairs = []string{"()", "[]", "{}", "<>", `""`, "''", "``"}
+
+// The selection moves with its lines when they scroll, into the history
+// too, and is only cleared when its cells are written over. Set to false
+// to clear it when output reaches its lines or it leaves the region.
+var keepselection = true
+
 // selection timeouts (in milliseconds)
 var doubleclicktimeout = 300 * time.Millisecond
 var tripleclicktimeout = 600 * time.Millisecond
@@ -43,6 +65,40 @@ var tripleclicktimeout = 600 * time.Millisecond
 // alt screens
 var allowaltscreen = true
 
+// number of lines kept in the scroll back history
+var histsize = 2000
+
+// append the exit status of the last command reported by the shell
+// through OSC 133 to the window title
+var titlestatus = false
+
+// maximum size in bytes of a string sequence (OSC, DCS, APC, PM), the longer
+// ones are ignored. Images are sent in these, so don't make it too small.
+var strbufmax = 16 << 20
+
+// maximum size in bytes of the decoded images and of their copies scaled
+// to the cells, the least recently used are dropped to make room
+var imgmaxstorage = 320 << 20
+
+// OSC 52 selection access. Allowing the programs to read the selection lets
+// anything printed to the terminal (a remote host, a malicious file) see your
+// clipboard.
+var allowosc52read = false
+
+// maximum size in bytes of the base64 data transferred by OSC 52
+var osc52maxlen = 1 << 20
+
+// desktop notifications requested with OSC 9, 777 and 99
+// notifycmd is run with the title and body appended to it, leave it empty to
+// use the freedesktop notification service on D-Bus. Example:
+//
+//	var notifycmd = []string{"notify-send", "-a", "st"}
+var notifycmd = []string{}
+
+// at most notifyburst notifications are shown at once, then one per notifyrate
+var notifyburst = 3
+var notifyrate = 10 * time.Second
+
 // frames per second st should at maximum draw to the screen
 var xfps time.Duration = 120
 var actionfps time.Duration = 30
@@ -60,6 +116,10 @@ var bellvolume = 0
 // default TERM value
 var termname = "xterm-256color"
 
+// record the input as well as the output with -R, note this includes
+// anything typed at password prompts
+var recordinput = false
+
 // spaces per tab
 //
 // When you are changing this value, don't forget to adapt the »it« value in
@@ -109,6 +169,14 @@ var defaultbg uint32 = 0
 var defaultcs uint32 = 256
 var defaultrcs uint32 = 257
 
+// cursor color in copy mode
+var copymodecs uint32 = 3
+
+// colors of the search matches and of the current one
+var searchfg uint32 = 0
+var searchbg uint32 = 3
+var searchcurbg uint32 = 11
+
 // Default shape of cursor
 // 2: Block ("█")
 // 4: Underline ("_")
@@ -156,6 +224,78 @@ var shortcuts = []Shortcut{
 	{TERMMOD, xk.Y, selpaste, 0},
 	{xlib.ShiftMask, xk.Insert, selpaste, 0},
 	{TERMMOD, xk.Num_Lock, numlock, 0},
+	{xlib.ShiftMask, xk.Prior, kscrollup, -1},
+	{xlib.ShiftMask, xk.Next, kscrolldown, -1},
+	{TERMMOD, xk.Z, kscrollprompt, -1},
+	{TERMMOD, xk.X, kscrollprompt, +1},
+	{TERMMOD, xk.O, copycmdoutput, 0},
+	{TERMMOD, xk.Return, newterm, 0},
+	{TERMMOD, xk.M, copymodestart, 0},
+	{TERMMOD, xk.F, searchstart, +1},
+	{TERMMOD, xk.B, searchstart, -1},
+	{TERMMOD, xk.U, hintstart, HINT_OPEN},
+	{TERMMOD, xk.H, hintstart, HINT_COPY},
+	{TERMMOD, xk.P, hintstart, HINT_PASTE},
+	{TERMMOD, xk.E, externalpipe, ExternalPipe{cmd: []string{"sh", "-c", "xurls | dmenu -l 10 | xargs -r xdg-open"}}},
+	{TERMMOD, xk.W, externalpipe, ExternalPipe{cmd: []string{"sh", "-c", "tr -s ' ' '\\n' | sort -u | dmenu -l 10"}, hist: true, reply: true}},
+	{TERMMOD, xk.F5, export, Export{format: EXPORT_HTML}},
+	{TERMMOD, xk.F6, export, Export{format: EXPORT_SVG}},
+	{TERMMOD, xk.F7, export, Export{format: EXPORT_ANSI}},
+	{TERMMOD, xk.F8, export, Export{format: EXPORT_HTML, sel: true, clip: true}},
+	{TERMMOD, xk.F9, export, Export{format: EXPORT_ANSI, sel: true, clip: true}},
+}
+
+// Search patterns are regular expressions rather than plain text, and
+// the case is ignored. Both can be toggled in the prompt with ctrl-r and
+// ctrl-t.
+var searchregex = false
+var searchignorecase = true
+
+// Hint mode labels the matches of these patterns in the view, a pattern
+// wins over the ones after it: URLs, paths and git hashes.
+var hintpatterns = []string{
+	`(https?|ftp|file)://[\w\-.~:/?#\[\]@!$&'()*+,;=%]*[\w\-~/#@$&*+=%]`,
+	`(~|\.{1,2}|[\w.\-]+)?/[\w.\-~/]*[\w\-~]`,
+	`\b[0-9a-f]{7,40}\b`,
+}
+
+// chars the hint labels are made of
+var hintalphabet = "asdfghjklqwertyuiopzxcvbnm"
+
+// command hints are opened with, the match is added to the arguments.
+// The matches starting with - are not opened, they would be options.
+var hintopen = []string{"xdg-open"}
+
+// directory the screen exports are written to, named after the time, the
+// home directory if empty
+var exportdir = ""
+
+// What to do with the control characters in pastes: PASTE_KEEP,
+// PASTE_STRIP or PASTE_CARET to show them as ^X. Tabs and line endings
+// are always kept, and a paste never ends bracketed paste early.
+var pastefilter = PASTE_STRIP
+
+// Ask before pasting several lines when the application has not turned
+// on bracketed paste, as a shell would run them right away.
+var pasteconfirm = true
+
+// time after which a transfer of a large selection to a client that
+// stopped reading it is dropped
+var incrtimeout = 10 * time.Second
+
+// Replay controls, checked before the shortcuts above with -P.
+var playshortcuts = []Shortcut{
+	/* mask                 keysym          function        argument */
+	{XK_NO_MOD, xk.Return, playpause, 0},
+	{XK_NO_MOD, xk.Next, playstep, 0},
+	{XK_ANY_MOD, xk.KP_Add, playspeed, 2.0},
+	{XK_ANY_MOD, xk.KP_Subtract, playspeed, 0.5},
+	{XK_ANY_MOD, xk.KP_Multiply, playspeed, 0.0},
+	{XK_NO_MOD, xk.Left, playskip, -5.0},
+	{XK_NO_MOD, xk.Right, playskip, +5.0},
+	{XK_NO_MOD, xk.Down, playskip, -60.0},
+	{XK_NO_MOD, xk.Up, playskip, +60.0},
+	{XK_NO_MOD, xk.Home, playskip, -1e9},
 }
 
 // State bits to ignore when matching key or button events.  By default,
@@ -0,0 +1,250 @@
+package main
+
+import "unicode"
+
+// Keyboard selection in the manner of vi. A cursor is moved over the
+// view with hjkl, w, b, e, 0, $, gg and G, scrolling through the history
+// when it goes past the top or the bottom. v, V and ctrl-v select from
+// where they were pressed to the cursor.
+
+type CopyMode struct {
+	active bool
+	x, y   int  // cursor in the view
+	typ    int  // SEL_REGULAR or SEL_RECTANGULAR, 0 when not selecting
+	line   bool // whole lines, for V
+	ax, ai int  // where the selection started, ai counts from the oldest line in history
+	g      bool // g pressed, waiting for the second one
+}
+
+var copymode CopyMode
+
+func copymodestart(interface{}) {
+	if copymode.active {
+		copymodeleave()
+		return
+	}
+	copymode = CopyMode{active: true, x: term.c.x, y: term.c.y + term.scr}
+	if copymode.y >= term.row {
+		copymode.x, copymode.y = 0, term.row-1
+	}
+	selclear()
+	tfulldirt()
+}
+
+// copymodeleave ends copy mode, keeping the selection
+func copymodeleave() {
+	copymode.active = false
+	tfulldirt()
+}
+
+// copymodekey handles the keys moving the cursor or selecting, q or
+// escape leave, the yank is done by the front end
+func copymodekey(s string) {
+	c := &copymode
+	i := term.histn - term.scr + c.y
+	last := term.histn + term.row - 1
+
+	if c.g {
+		c.g = false
+		if s == "g" {
+			copymodegoto(0, 0)
+		}
+		return
+	}
+
+	switch s {
+	case "h":
+		copymodegoto(c.x-1, i)
+	case "l":
+		copymodegoto(c.x+1, i)
+	case "k":
+		copymodegoto(c.x, i-1)
+	case "j":
+		copymodegoto(c.x, i+1)
+	case "0":
+		copymodegoto(0, i)
+	case "$":
+		copymodegoto(max(copymodelinelen(i)-1, 0), i)
+	case "w", "b", "e":
+		x, i := copymodeword(c.x, i, s[0])
+		copymodegoto(x, i)
+	case "g":
+		c.g = true
+	case "G":
+		copymodegoto(0, last)
+	case "v":
+		copymodeselect(SEL_REGULAR, false)
+	case "V":
+		copymodeselect(SEL_REGULAR, true)
+	case "\026": // ctrl-v
+		copymodeselect(SEL_RECTANGULAR, false)
+	case "q", "\033":
+		if c.typ != 0 && s == "\033" {
+			c.typ = 0
+			selclear()
+			return
+		}
+		copymodeleave()
+	}
+}
+
+// copymodegoto moves the cursor to column x of line i, counted from the
+// oldest line in history, scrolling to bring the line into the view
+func copymodegoto(x, i int) {
+	c := &copymode
+	i = clamp(i, 0, term.histn+term.row-1)
+	if top := term.histn - term.scr; i < top {
+		kscrollup(top - i)
+	} else if i >= top+term.row {
+		kscrolldown(i - top - term.row + 1)
+	}
+
+	oy := c.y
+	dir := x - c.x
+	c.x = clamp(x, 0, term.col-1)
+	c.y = clamp(i-term.histn+term.scr, 0, term.row-1)
+
+	// stay off the second half of wide chars
+	if tline(c.y)[c.x].mode&ATTR_WDUMMY != 0 {
+		if dir > 0 && c.x < term.col-1 {
+			c.x++
+		} else if c.x > 0 {
+			c.x--
+		}
+	}
+	tsetdirt(oy, oy)
+	tsetdirt(c.y, c.y)
+	copymodesel()
+}
+
+// copymodeselect starts selecting, changes the kind of the selection
+// or stops selecting when pressed again
+func copymodeselect(typ int, line bool) {
+	c := &copymode
+	switch {
+	case c.typ == typ && c.line == line:
+		c.typ = 0
+		selclear()
+		return
+	case c.typ == 0:
+		c.ax, c.ai = c.x, term.histn-term.scr+c.y
+	}
+	c.typ, c.line = typ, line
+	copymodesel()
+}
+
+// copymodesel selects from the start to the cursor
+func copymodesel() {
+	c := &copymode
+	if c.typ == 0 {
+		return
+	}
+	ax, ay := c.ax, c.ai-term.histn+term.scr
+
+	snap := 0
+	if c.line {
+		snap = SNAP_LINE
+	}
+	selstart(ax, ay, snap)
+	selextend(c.x, c.y, c.typ, false)
+}
+
+func copymodelinelen(i int) int {
+	l := thistline(i)
+	n := term.col
+	for n > 0 && (l[n-1].u == ' ' || l[n-1].u == 0) {
+		n--
+	}
+	return n
+}
+
+// copymodeclass tells blanks (0) from punctuation (1) and the letters,
+// digits and underscores words are made of (2)
+func copymodeclass(x, i int) int {
+	l := thistline(i)
+	if l[x].mode&ATTR_WDUMMY != 0 && x > 0 {
+		x--
+	}
+	u := l[x].u
+	switch {
+	case u == ' ' || u == 0:
+		return 0
+	case u == '_' || unicode.IsLetter(u) || unicode.IsDigit(u):
+		return 2
+	}
+	return 1
+}
+
+// copymodestep moves one cell forward or backward across lines, it
+// returns false at either end and reports the line breaks that are not
+// wraps as they separate words
+func copymodestep(x, i *int, dir int) (ok, brk bool) {
+	last := term.histn + term.row - 1
+	nx, ni := *x+dir, *i
+	if nx < 0 {
+		if ni == 0 {
+			return false, false
+		}
+		ni--
+		nx = term.col - 1
+		brk = thistline(ni)[nx].mode&ATTR_WRAP == 0
+	} else if nx >= term.col {
+		if ni == last {
+			return false, false
+		}
+		brk = thistline(ni)[term.col-1].mode&ATTR_WRAP == 0
+		ni++
+		nx = 0
+	}
+	*x, *i = nx, ni
+	return true, brk
+}
+
+// copymodeword returns where the w, b and e motions go
+func copymodeword(x, i int, motion byte) (int, int) {
+	switch motion {
+	case 'w':
+		// past the end of this word, then past the blanks
+		cls := copymodeclass(x, i)
+		blank := cls == 0
+		for {
+			ok, brk := copymodestep(&x, &i, +1)
+			if !ok {
+				break
+			}
+			c := copymodeclass(x, i)
+			if brk {
+				blank = true
+			}
+			if c != 0 && (blank || c != cls) {
+				break
+			}
+			if c == 0 {
+				blank = true
+			}
+		}
+	case 'b', 'e':
+		dir := +1
+		if motion == 'b' {
+			dir = -1
+		}
+		// to the first char of the next word in that direction, then
+		// to its last one
+		for {
+			ok, _ := copymodestep(&x, &i, dir)
+			if !ok || copymodeclass(x, i) != 0 {
+				break
+			}
+		}
+		cls := copymodeclass(x, i)
+		for cls != 0 {
+			nx, ni := x, i
+			ok, brk := copymodestep(&nx, &ni, dir)
+			if !ok || brk || copymodeclass(nx, ni) != cls {
+				break
+			}
+			x, i = nx, ni
+		}
+	}
+	return x, i
+}
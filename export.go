@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image/color"
+	"os"
+	"strings"
+	"time"
+)
+
+// Export of the screen or of the selection with the colors and
+// attributes of the glyphs, as HTML, SVG or ANSI escape sequences.
+
+const (
+	EXPORT_HTML = iota
+	EXPORT_SVG
+	EXPORT_ANSI
+)
+
+type Export struct {
+	format int
+	sel    bool // the selection rather than the screen
+	clip   bool // to the clipboard rather than to a file in exportdir
+}
+
+type ExportLine struct {
+	x    int     // column of the first glyph
+	g    []Glyph // without the trailing blanks
+	wrap bool    // continued on the next line
+}
+
+// the attributes that change how a glyph looks in an export
+const exportattrs = ATTR_BOLD | ATTR_FAINT | ATTR_ITALIC | ATTR_UNDERLINE |
+	ATTR_BLINK | ATTR_REVERSE | ATTR_INVISIBLE | ATTR_STRUCK
+
+func export(arg interface{}) {
+	e := arg.(Export)
+	lines := exportlines(e.sel)
+	if lines == nil {
+		return
+	}
+
+	var data []byte
+	var ext string
+	switch e.format {
+	case EXPORT_HTML:
+		data, ext = exporthtml(lines), ".html"
+	case EXPORT_SVG:
+		data, ext = exportsvg(lines), ".svg"
+	case EXPORT_ANSI:
+		data, ext = exportansi(lines), ".ans"
+	}
+	if data == nil {
+		return
+	}
+
+	if e.clip {
+		xsetclipboard(data)
+		return
+	}
+	if _, err := exportfile(data, ext); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+	}
+}
+
+// exportfile writes data to a new file of exportdir, readable by the user
+// only, and returns its name
+func exportfile(data []byte, ext string) (string, error) {
+	dir := exportdir
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = home
+	}
+	// CreateTemp never opens an existing file, so two exports in the
+	// same second or a planted link are no harm
+	f, err := os.CreateTemp(dir, time.Now().Format("st-20060102-150405-")+"*"+ext)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// exportblank tells if a glyph shows nothing but the default background
+func exportblank(g Glyph) bool {
+	return (g.u == ' ' || g.u == 0) && g.bg == defaultbg && g.img == 0 &&
+		g.mode&(ATTR_REVERSE|ATTR_UNDERLINE|ATTR_STRUCK) == 0
+}
+
+// exportlines returns the lines of the view, or the part of them in the
+// selection, nil if there is no selection
+func exportlines(selonly bool) []ExportLine {
+	top, bot := 0, term.row-1
+	if selonly {
+		if sel.ob.x == -1 {
+			return nil
+		}
+		top, bot = sel.nb.y, sel.ne.y
+	}
+
+	lines := []ExportLine{}
+	for y := top; y <= bot; y++ {
+		gp := tline(y)
+		x, lastx := 0, term.col-1
+		if selonly {
+			if sel.typ == SEL_RECTANGULAR {
+				x, lastx = sel.nb.x, sel.ne.x
+			} else {
+				if y == sel.nb.y {
+					x = sel.nb.x
+				}
+				if y == sel.ne.y {
+					lastx = sel.ne.x
+				}
+			}
+		}
+
+		wrap := lastx == term.col-1 && gp[lastx].mode&ATTR_WRAP != 0
+		for lastx >= x && exportblank(gp[lastx]) {
+			lastx--
+		}
+		lines = append(lines, ExportLine{x, gp[x : lastx+1], wrap})
+	}
+	return lines
+}
+
+// getselhtml returns the selected cells as HTML, nil if there is no
+// selection
+func getselhtml() []byte {
+	lines := exportlines(true)
+	if lines == nil {
+		return nil
+	}
+	return exporthtml(lines)
+}
+
+// exportruns calls f for each run of glyphs drawn alike, with the
+// column of the run and its text
+func exportruns(l ExportLine, f func(g Glyph, x, n int, s string)) {
+	var sb strings.Builder
+	for i := 0; i < len(l.g); {
+		g := l.g[i]
+		n := 0
+		sb.Reset()
+		for ; i < len(l.g); i++ {
+			c := l.g[i]
+			if c.fg != g.fg || c.bg != g.bg || c.mode&exportattrs != g.mode&exportattrs {
+				break
+			}
+			n++
+			if c.mode&ATTR_WDUMMY != 0 {
+				continue
+			}
+			if c.u == 0 {
+				c.u = ' '
+			}
+			sb.WriteRune(c.u)
+		}
+		f(g, l.x+i-n, n, sb.String())
+	}
+}
+
+func exportpalette() []color.RGBA {
+	pal, err := renderpalette()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+	}
+	return pal
+}
+
+func hexcolor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func exporthtml(lines []ExportLine) []byte {
+	pal := exportpalette()
+	if pal == nil {
+		return nil
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<meta charset=\"utf-8\"><pre style=\"color:%s;background-color:%s\">",
+		hexcolor(pal[defaultfg]), hexcolor(pal[defaultbg]))
+	for i, l := range lines {
+		exportruns(l, func(g Glyph, x, n int, s string) {
+			fg, bg := glyphcolors(pal, g)
+			var style []string
+			if fg != pal[defaultfg] {
+				style = append(style, "color:"+hexcolor(fg))
+			}
+			if bg != pal[defaultbg] {
+				style = append(style, "background-color:"+hexcolor(bg))
+			}
+			if g.mode&ATTR_BOLD != 0 {
+				style = append(style, "font-weight:bold")
+			}
+			if g.mode&ATTR_ITALIC != 0 {
+				style = append(style, "font-style:italic")
+			}
+			var deco []string
+			if g.mode&ATTR_UNDERLINE != 0 {
+				deco = append(deco, "underline")
+			}
+			if g.mode&ATTR_STRUCK != 0 {
+				deco = append(deco, "line-through")
+			}
+			if deco != nil {
+				style = append(style, "text-decoration:"+strings.Join(deco, " "))
+			}
+
+			if style == nil {
+				b.WriteString(html.EscapeString(s))
+			} else {
+				fmt.Fprintf(&b, "<span style=\"%s\">%s</span>",
+					strings.Join(style, ";"), html.EscapeString(s))
+			}
+		})
+		if !l.wrap && i < len(lines)-1 {
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString("</pre>\n")
+	return b.Bytes()
+}
+
+func exportsvg(lines []ExportLine) []byte {
+	pal := exportpalette()
+	if pal == nil {
+		return nil
+	}
+
+	// without a window there is no font to measure, guess
+	cw, ch := xgetcellsize()
+	if cw == 0 || ch == 0 {
+		cw, ch = 8, 16
+	}
+	ascent := ch * 4 / 5
+
+	// a rectangular selection starts past the first column
+	left := term.col
+	for _, l := range lines {
+		left = min(left, l.x)
+	}
+	cols := term.col - left
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" "+
+		"font-family=\"monospace\" font-size=\"%d\">\n", cols*cw, len(lines)*ch, ascent)
+	fmt.Fprintf(&b, "<rect width=\"100%%\" height=\"100%%\" fill=\"%s\"/>\n", hexcolor(pal[defaultbg]))
+	for j, l := range lines {
+		exportruns(l, func(g Glyph, x, n int, s string) {
+			fg, bg := glyphcolors(pal, g)
+			px, py := (x-left)*cw, j*ch
+			if bg != pal[defaultbg] {
+				fmt.Fprintf(&b, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n",
+					px, py, n*cw, ch, hexcolor(bg))
+			}
+			if strings.TrimLeft(s, " ") == "" && g.mode&(ATTR_UNDERLINE|ATTR_STRUCK) == 0 {
+				return
+			}
+
+			fmt.Fprintf(&b, "<text x=\"%d\" y=\"%d\" fill=\"%s\" textLength=\"%d\" "+
+				"lengthAdjust=\"spacingAndGlyphs\" xml:space=\"preserve\"",
+				px, py+ascent, hexcolor(fg), n*cw)
+			if g.mode&ATTR_BOLD != 0 {
+				b.WriteString(" font-weight=\"bold\"")
+			}
+			if g.mode&ATTR_ITALIC != 0 {
+				b.WriteString(" font-style=\"italic\"")
+			}
+			switch {
+			case g.mode&ATTR_UNDERLINE != 0 && g.mode&ATTR_STRUCK != 0:
+				b.WriteString(" text-decoration=\"underline line-through\"")
+			case g.mode&ATTR_UNDERLINE != 0:
+				b.WriteString(" text-decoration=\"underline\"")
+			case g.mode&ATTR_STRUCK != 0:
+				b.WriteString(" text-decoration=\"line-through\"")
+			}
+			fmt.Fprintf(&b, ">%s</text>\n", html.EscapeString(s))
+		})
+	}
+	b.WriteString("</svg>\n")
+	return b.Bytes()
+}
+
+// exportsgr writes the SGR sequence that sets the attributes of g
+func exportsgr(b *bytes.Buffer, g Glyph) {
+	b.WriteString("\033[0")
+	codes := []struct {
+		attr uint
+		code int
+	}{
+		{ATTR_BOLD, 1},
+		{ATTR_FAINT, 2},
+		{ATTR_ITALIC, 3},
+		{ATTR_UNDERLINE, 4},
+		{ATTR_BLINK, 5},
+		{ATTR_REVERSE, 7},
+		{ATTR_INVISIBLE, 8},
+		{ATTR_STRUCK, 9},
+	}
+	for _, c := range codes {
+		if g.mode&c.attr != 0 {
+			fmt.Fprintf(b, ";%d", c.code)
+		}
+	}
+	exportsgrcolor(b, 30, g.fg, defaultfg)
+	exportsgrcolor(b, 40, g.bg, defaultbg)
+	b.WriteByte('m')
+}
+
+func exportsgrcolor(b *bytes.Buffer, base int, c, def uint32) {
+	switch {
+	case istruecol(c):
+		fmt.Fprintf(b, ";%d;2;%d;%d;%d", base+8, (c>>16)&0xff, (c>>8)&0xff, c&0xff)
+	case c == def:
+	case c < 8:
+		fmt.Fprintf(b, ";%d", base+int(c))
+	case c < 16:
+		fmt.Fprintf(b, ";%d", base+60+int(c)-8)
+	case c < 256:
+		fmt.Fprintf(b, ";%d;5;%d", base+8, c)
+	}
+}
+
+func exportansi(lines []ExportLine) []byte {
+	var b bytes.Buffer
+	var cur Glyph
+	cur.fg, cur.bg = defaultfg, defaultbg
+	for _, l := range lines {
+		exportruns(l, func(g Glyph, x, n int, s string) {
+			if g.fg != cur.fg || g.bg != cur.bg || g.mode&exportattrs != cur.mode&exportattrs {
+				exportsgr(&b, g)
+				cur = g
+			}
+			b.WriteString(s)
+		})
+		if l.wrap {
+			continue
+		}
+		// the attributes do not carry over to the next line
+		if cur.fg != defaultfg || cur.bg != defaultbg || cur.mode&exportattrs != 0 {
+			b.WriteString("\033[0m")
+			cur = Glyph{fg: defaultfg, bg: defaultbg}
+		}
+		b.WriteByte('\n')
+	}
+	if cur.fg != defaultfg || cur.bg != defaultbg || cur.mode&exportattrs != 0 {
+		b.WriteString("\033[0m")
+	}
+	return b.Bytes()
+}
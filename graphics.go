@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Images are placed on the cell grid: every cell covered by an image
+// refers to the placement and knows which part of the image it shows,
+// so scrolling and clearing the screen move and erase images like text.
+// The images and their copies scaled to the cells share imgmaxstorage,
+// the least recently used go first when it is full.
+
+const (
+	IMG_MAX_PIXELS = 8192 * 8192
+	IMG_MAX_ROWS   = 1024
+)
+
+type Placement struct {
+	img        image.Image
+	cols, rows int         // size in cells
+	aspect     bool        // preserve the aspect ratio of the image
+	z          int         // drawn below the text when negative
+	id, pid    uint32      // kitty image and placement ids
+	pix        *image.RGBA // image scaled to the cells
+	pcw, pch   int         // cell size pix was scaled for
+	size       int         // bytes of img when it is not a kitty image
+	used       uint64      // last use, as imgclock
+}
+
+var (
+	placements  = map[uint32]*Placement{}
+	placementid uint32
+	placementgc = 32 // collect unused placements past this many
+	imgstored   int  // bytes of the images and scaled copies kept
+	imgclock    uint64
+)
+
+// imgsize returns the bytes an image takes in memory
+func imgsize(img image.Image) int {
+	b := img.Bounds()
+	return b.Dx() * b.Dy() * 4
+}
+
+// imgstamp returns the time of a use of an image
+func imgstamp() uint64 {
+	imgclock++
+	return imgclock
+}
+
+// imguncache drops the scaled copy of p
+func imguncache(p *Placement) {
+	if p.pix != nil {
+		imgstored -= imgsize(p.pix)
+		p.pix = nil
+	}
+}
+
+// imgdrop forgets the placement id and what it holds
+func imgdrop(id uint32) {
+	if p := placements[id]; p != nil {
+		imguncache(p)
+		imgstored -= p.size
+		delete(placements, id)
+	}
+}
+
+// imgoffscreen drops the scaled copies of the placements out of the view
+func imgoffscreen() {
+	shown := map[uint32]bool{}
+	for y := 0; y < term.row; y++ {
+		for _, g := range tline(y) {
+			shown[g.img] = true
+		}
+	}
+	for id, p := range placements {
+		if !shown[id] {
+			imguncache(p)
+		}
+	}
+}
+
+// imgquota makes room for n more bytes, dropping the scaled copies out
+// of the view, then the least recently used copies and images but the
+// ones of keep
+func imgquota(n int, keep *Placement) {
+	if imgstored+n <= imgmaxstorage {
+		return
+	}
+	imgoffscreen()
+	for imgstored+n > imgmaxstorage {
+		var p *Placement
+		var k *KittyImage
+		pid, old := uint32(0), ^uint64(0)
+		for id, q := range placements {
+			if q != keep && (q.pix != nil || q.size > 0) && q.used < old {
+				p, pid, old = q, id, q.used
+			}
+		}
+		for _, i := range kittyimages {
+			if (keep == nil || i.id != keep.id) && i.used < old {
+				k, old = i, i.used
+			}
+		}
+		switch {
+		case k != nil:
+			kittyfree(k.id)
+		case p != nil && p.pix != nil:
+			imguncache(p)
+		case p != nil:
+			imgdrop(pid)
+		default:
+			return
+		}
+	}
+}
+
+func imgdecode(data []byte) (image.Image, error) {
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width*conf.Height > IMG_MAX_PIXELS {
+		return nil, fmt.Errorf("bad image size %dx%d", conf.Width, conf.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// imgdim converts an image dimension given as N (cells), Npx (pixels),
+// N% (of the terminal) or auto into cells, -1 means auto
+func imgdim(spec string, cell, total int) int {
+	var n int
+	var err error
+	switch {
+	case spec == "" || spec == "auto":
+		return -1
+	case strings.HasSuffix(spec, "px"):
+		n, err = strconv.Atoi(strings.TrimSuffix(spec, "px"))
+		n = divceil(n, cell)
+	case strings.HasSuffix(spec, "%"):
+		n, err = strconv.Atoi(strings.TrimSuffix(spec, "%"))
+		n = total * n / 100
+	default:
+		n, err = strconv.Atoi(spec)
+	}
+	if err != nil || n <= 0 {
+		return -1
+	}
+	return n
+}
+
+// imgcellsize returns the size of a cell, guessed when there is no
+// window to measure the font in
+func imgcellsize() (int, int) {
+	cw, ch := xgetcellsize()
+	if cw <= 0 || ch <= 0 {
+		return 8, 16
+	}
+	return cw, ch
+}
+
+// imgfit computes the size in cells of an image, the auto dimensions
+// follow the other one when preserving the aspect ratio
+func imgfit(img image.Image, cols, rows int, aspect bool) (int, int) {
+	cw, ch := imgcellsize()
+	b := img.Bounds()
+	switch {
+	case cols < 0 && rows < 0:
+		cols = divceil(b.Dx(), cw)
+		rows = divceil(b.Dy(), ch)
+	case cols < 0 && aspect:
+		cols = divceil(rows*ch*b.Dx()/b.Dy(), cw)
+	case cols < 0:
+		cols = divceil(b.Dx(), cw)
+	case rows < 0 && aspect:
+		rows = divceil(cols*cw*b.Dy()/b.Dx(), ch)
+	case rows < 0:
+		rows = divceil(b.Dy(), ch)
+	}
+	return clamp(cols, 1, term.col), clamp(rows, 1, IMG_MAX_ROWS)
+}
+
+// imgscaled returns the placement image scaled to its cells
+func imgscaled(p *Placement, cw, ch int) *image.RGBA {
+	p.used = imgstamp()
+	if k := kittyimages[p.id]; p.id != 0 && k != nil {
+		k.used = p.used
+	}
+	if p.pix != nil && p.pcw == cw && p.pch == ch {
+		return p.pix
+	}
+
+	imguncache(p)
+	imgquota(p.cols*cw*p.rows*ch*4, p)
+	p.pix = image.NewRGBA(image.Rect(0, 0, p.cols*cw, p.rows*ch))
+	p.pcw, p.pch = cw, ch
+	imgstored += imgsize(p.pix)
+
+	r := p.pix.Bounds()
+	b := p.img.Bounds()
+	if p.aspect {
+		// fit in the cells, centered
+		w, h := r.Dx(), r.Dy()
+		if w*b.Dy() > h*b.Dx() {
+			w = h * b.Dx() / b.Dy()
+		} else {
+			h = w * b.Dy() / b.Dx()
+		}
+		r = image.Rect(0, 0, w, h).Add(image.Pt((r.Dx()-w)/2, (r.Dy()-h)/2))
+	}
+	xdraw.ApproxBiLinear.Scale(p.pix, r, p.img, b, xdraw.Src, nil)
+	return p.pix
+}
+
+// imggc forgets about the placements not shown in any cell anymore, and
+// the kitty images they were the last to show. The scaled copies out of
+// the view are dropped too.
+func imggc() {
+	used := map[uint32]bool{}
+	mark := func(lines []Line) {
+		for _, l := range lines {
+			for _, g := range l {
+				if g.img != 0 {
+					used[g.img] = true
+				}
+			}
+		}
+	}
+	mark(term.line)
+	mark(term.alt)
+	mark(term.hist)
+
+	shown := map[uint32]bool{}
+	for id, p := range placements {
+		if !used[id] {
+			imgdrop(id)
+		} else if p.id != 0 {
+			shown[p.id] = true
+		}
+	}
+	for id, k := range kittyimages {
+		if k.placed && !shown[id] {
+			delete(kittyimages, id)
+			imgstored -= k.size
+		}
+	}
+	imgoffscreen()
+	placementgc = max(32, 2*len(placements))
+}
+
+// imgreset forgets all the images, for a terminal made anew
+func imgreset() {
+	placements = map[uint32]*Placement{}
+	placementgc = 32
+	imgstored = 0
+	kittyimages = map[uint32]*KittyImage{}
+	kittypending, kittydata = nil, nil
+}
+
+// tplaceimage puts the placement p at the cursor position, scrolling
+// if needed, and leaves the cursor at the right of its last row
+func tplaceimage(p *Placement) uint32 {
+	placementid++
+	if placementid == 0 {
+		placementid++
+	}
+	id := placementid
+	placements[id] = p
+
+	x := term.c.x
+	cols := min(p.cols, term.col-x)
+	for r := 0; r < p.rows; r++ {
+		if r > 0 {
+			tnewline(true)
+			tmoveto(x, term.c.y)
+		}
+		for c := 0; c < cols; c++ {
+			tsetchar(' ', &term.c.attr, x+c, term.c.y)
+			gp := &term.line[term.c.y][x+c]
+			gp.img = id
+			gp.imgx = uint16(c)
+			gp.imgy = uint16(r)
+		}
+	}
+	if x+cols < term.col {
+		tmoveto(x+cols, term.c.y)
+	} else {
+		term.c.state |= CURSOR_WRAPNEXT
+	}
+
+	if len(placements) > placementgc {
+		imggc()
+	}
+	return id
+}
+
+// tinlineimage handles the iTerm2 protocol:
+// 1337 ; File = [key=value [; key=value ...]] : base64 data
+func tinlineimage(p []byte) {
+	arg, data, ok := bytes.Cut(p, []byte(":"))
+	if !ok || !bytes.HasPrefix(arg, []byte("File=")) {
+		fmt.Fprintf(os.Stderr, "erresc: unknown iTerm2 sequence\n")
+		return
+	}
+
+	inline := false
+	aspect := true
+	width, height := "auto", "auto"
+	for _, kv := range strings.Split(string(arg[len("File="):]), ";") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "inline":
+			inline = v == "1"
+		case "width":
+			width = v
+		case "height":
+			height = v
+		case "preserveAspectRatio":
+			aspect = v != "0"
+		}
+	}
+	if !inline {
+		// downloading files is not supported
+		return
+	}
+
+	dec, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erresc: invalid base64")
+		return
+	}
+	img, err := imgdecode(dec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "erresc: invalid image: %v\n", err)
+		return
+	}
+
+	size := imgsize(img)
+	if size > imgmaxstorage {
+		fmt.Fprintln(os.Stderr, "erresc: image too large")
+		return
+	}
+	imgquota(size, nil)
+
+	cw, ch := imgcellsize()
+	cols, rows := imgfit(img, imgdim(width, cw, term.col), imgdim(height, ch, term.row), aspect)
+	imgstored += size
+	tplaceimage(&Placement{
+		img:    img,
+		cols:   cols,
+		rows:   rows,
+		aspect: aspect,
+		size:   size,
+		used:   imgstamp(),
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+// Hint mode: the matches of hintpatterns in the view get short labels
+// drawn over their first cells, typing a label copies the match, opens
+// it with hintopen or types it.
+
+const (
+	HINT_COPY = iota
+	HINT_OPEN
+	HINT_PASTE
+)
+
+type Hint struct {
+	m     SearchMatch
+	text  string
+	label string
+}
+
+type Hints struct {
+	active bool
+	action int
+	list   []Hint
+	typed  string
+}
+
+var hints Hints
+
+var hintres []*regexp.Regexp // hintpatterns, compiled on first use
+
+func hintstart(arg interface{}) {
+	if hintres == nil {
+		for _, p := range hintpatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "hint pattern %q: %v\n", p, err)
+				continue
+			}
+			hintres = append(hintres, re)
+		}
+	}
+
+	var list []Hint
+	for _, re := range hintres {
+		tmatches(re, term.histn-term.scr, term.row, func(m SearchMatch, s string) {
+			for _, h := range list {
+				if hintoverlap(h.m, m) {
+					return
+				}
+			}
+			list = append(list, Hint{m: m, text: s})
+		})
+	}
+	if len(list) == 0 {
+		return
+	}
+	sort.Slice(list, func(a, b int) bool {
+		ma, mb := list[a].m, list[b].m
+		return ma.i1 < mb.i1 || (ma.i1 == mb.i1 && ma.x1 < mb.x1)
+	})
+	for i, l := range hintlabels(len(list)) {
+		list[i].label = l
+	}
+
+	hints = Hints{active: true, action: arg.(int), list: list}
+	tfulldirt()
+}
+
+func hintstop() {
+	hints = Hints{}
+	tfulldirt()
+}
+
+// hintoverlap tells if two matches share a cell
+func hintoverlap(a, b SearchMatch) bool {
+	before := func(i1, x1, i2, x2 int) bool {
+		return i1 < i2 || (i1 == i2 && x1 < x2)
+	}
+	return !before(a.i2, a.x2, b.i1, b.x1) && !before(b.i2, b.x2, a.i1, a.x1)
+}
+
+// hintlabels returns n labels of the same length made of the chars of
+// hintalphabet, so that none is the prefix of another
+func hintlabels(n int) []string {
+	alpha := []rune(hintalphabet)
+	size := 1
+	for k := len(alpha); k < n; k *= len(alpha) {
+		size++
+	}
+
+	labels := make([]string, n)
+	l := make([]rune, size)
+	for i := range labels {
+		for j, k := size-1, i; j >= 0; j-- {
+			l[j] = alpha[k%len(alpha)]
+			k /= len(alpha)
+		}
+		labels[i] = string(l)
+	}
+	return labels
+}
+
+// hintkey handles a key typed in hint mode, a key that no label goes on
+// with is ignored
+func hintkey(s string) {
+	switch s {
+	case "":
+		return
+	case "\033":
+		hintstop()
+		return
+	case "\b", "\177":
+		_, n := utf8.DecodeLastRuneInString(hints.typed)
+		hints.typed = hints.typed[:len(hints.typed)-n]
+		tfulldirt()
+		return
+	}
+
+	typed := hints.typed + s
+	found := false
+	for _, h := range hints.list {
+		if h.label == typed {
+			action := hints.action
+			hintstop()
+			hintrun(action, h.text)
+			return
+		}
+		if strings.HasPrefix(h.label, typed) {
+			found = true
+		}
+	}
+	if found {
+		hints.typed = typed
+		tfulldirt()
+	}
+}
+
+func hintrun(action int, text string) {
+	switch action {
+	case HINT_COPY:
+		xsetsel([]byte(text))
+		xsetclipboard([]byte(text))
+	case HINT_OPEN:
+		if len(hintopen) == 0 {
+			return
+		}
+		// xdg-open knows no "--" to end its options
+		if strings.HasPrefix(text, "-") {
+			fmt.Fprintf(os.Stderr, "hint: not opening %q, it looks like an option\n", text)
+			return
+		}
+		args := append(append([]string{}, hintopen[1:]...), text)
+		exe := exec.Command(hintopen[0], args...)
+		exe.SysProcAttr = &syscall.SysProcAttr{
+			Setsid: true,
+		}
+		if err := exe.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "hint: can't start %s: %v\n", hintopen[0], err)
+			return
+		}
+		go exe.Wait()
+	case HINT_PASTE:
+		ttywrite([]byte(text), true)
+	}
+}
+
+// hintline returns the row y of the view as drawn in hint mode, with
+// the matches highlighted and the rest of their labels over them
+func hintline(line Line, y int) Line {
+	i := term.histn - term.scr + y
+	copied := false
+	for _, h := range hints.list {
+		m := h.m
+		if i < m.i1 || i > m.i2 || !strings.HasPrefix(h.label, hints.typed) {
+			continue
+		}
+		if !copied {
+			line = append(Line(nil), line...)
+			copied = true
+		}
+
+		x1, x2 := 0, term.col-1
+		if i == m.i1 {
+			x1 = m.x1
+		}
+		if i == m.i2 {
+			x2 = m.x2
+		}
+		for x := x1; x <= x2; x++ {
+			line[x].mode |= ATTR_HIGHLIGHT
+		}
+		if i != m.i1 {
+			continue
+		}
+
+		x := m.x1
+		for _, u := range h.label[len(hints.typed):] {
+			if x >= term.col {
+				break
+			}
+			// a label char takes a single cell
+			if line[x].mode&ATTR_WIDE != 0 && x+1 < term.col {
+				line[x+1].u = ' '
+				line[x+1].mode &^= ATTR_WDUMMY
+			}
+			line[x].u = u
+			line[x].mode &^= ATTR_WIDE | ATTR_WDUMMY
+			line[x].mode |= ATTR_HIGHLIGHT | ATTR_HIGHLIGHT_CUR | ATTR_BOLD
+			x++
+		}
+	}
+	return line
+}
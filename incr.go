@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"github.com/qeedquan/go-media/x11/xlib"
+)
+
+// INCR transfers of selections too large for a single request: the
+// requestor deletes the property to ask for each chunk, and an empty
+// chunk ends the transfer. The requestor is st itself when it pastes
+// its own selection. The X side is in xincrstart and xincrsend.
+
+type Incr struct {
+	requestor xlib.Window
+	property  xlib.Atom
+	typ       xlib.Atom
+	data      []byte // left to send
+	last      time.Time
+}
+
+var incrs []*Incr // transfers in progress
+
+// incrstart adds a transfer of data, replacing the one to the same
+// property of w
+func incrstart(w xlib.Window, property, typ xlib.Atom, data []byte) {
+	for i, t := range incrs {
+		if t.requestor == w && t.property == property {
+			incrs = append(incrs[:i], incrs[i+1:]...)
+			break
+		}
+	}
+	incrs = append(incrs, &Incr{w, property, typ, data, time.Now()})
+}
+
+// incrnext returns the next chunk of at most size bytes of the transfer
+// to property of w, and the transfer if there is one. The transfer is
+// over once its empty chunk is returned.
+func incrnext(w xlib.Window, property xlib.Atom, size int) ([]byte, *Incr) {
+	for i, t := range incrs {
+		if t.requestor != w || t.property != property {
+			continue
+		}
+		n := min(len(t.data), size)
+		chunk := t.data[:n]
+		t.data = t.data[n:]
+		t.last = time.Now()
+		if n == 0 {
+			incrs = append(incrs[:i], incrs[i+1:]...)
+		}
+		return chunk, t
+	}
+	return nil, nil
+}
+
+// incrbusy tells if w has transfers in progress
+func incrbusy(w xlib.Window) bool {
+	for _, t := range incrs {
+		if t.requestor == w {
+			return true
+		}
+	}
+	return false
+}
+
+// incrdrop drops the transfers to w, which is gone
+func incrdrop(w xlib.Window) {
+	i := 0
+	for _, t := range incrs {
+		if t.requestor != w {
+			incrs[i] = t
+			i++
+		}
+	}
+	incrs = incrs[:i]
+}
+
+// incrgc drops the transfers whose requestor stopped reading for
+// incrtimeout, it returns the windows left without any
+func incrgc() []xlib.Window {
+	var idle []xlib.Window
+	i := 0
+	for _, t := range incrs {
+		if time.Since(t.last) < incrtimeout {
+			incrs[i] = t
+			i++
+		} else {
+			idle = append(idle, t.requestor)
+		}
+	}
+	incrs = incrs[:i]
+
+	var done []xlib.Window
+	for _, w := range idle {
+		if !incrbusy(w) {
+			done = append(done, w)
+		}
+	}
+	return done
+}
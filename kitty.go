@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Kitty graphics protocol, sent in APC sequences:
+// ESC _ G key=value[,key=value ...] [; payload] ESC \
+// https://sw.kovidgoyal.net/kitty/graphics-protocol/
+
+const KITTY_MAX_DATA = 64 << 20
+
+type KittyImage struct {
+	id     uint32
+	number uint32
+	img    image.Image
+	size   int    // bytes the decoded image takes
+	used   uint64 // last use, as imgclock
+	placed bool   // freed once no placement shows it anymore
+}
+
+// KittyCmd holds the control data of a graphics command
+type KittyCmd struct {
+	action   byte   // a
+	quiet    int    // q
+	format   int    // f
+	medium   byte   // t
+	width    int    // s
+	height   int    // v
+	size     int    // S
+	offset   int    // O
+	compress byte   // o
+	id       uint32 // i
+	number   uint32 // I
+	pid      uint32 // p
+	more     bool   // m
+	x, y     int    // source rectangle
+	w, h     int
+	cols     int // c
+	rows     int // r
+	z        int
+	nomove   bool // C
+	del      byte // d
+}
+
+var (
+	kittyimages  = map[uint32]*KittyImage{}
+	kittynextid  = uint32(1 << 31) // ids given to images sent with a number only
+	kittypending *KittyCmd         // command being transferred in chunks
+	kittydata    []byte
+)
+
+func kittyparse(ctrl []byte) (*KittyCmd, error) {
+	c := &KittyCmd{
+		action: 't',
+		format: 32,
+		medium: 'd',
+	}
+	for _, kv := range strings.Split(string(ctrl), ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || len(k) != 1 || v == "" {
+			return nil, fmt.Errorf("invalid key %q", kv)
+		}
+
+		n, err := strconv.ParseInt(v, 10, 64)
+		if len(v) == 1 && err != nil {
+			n, err = int64(v[0]), nil
+		}
+		if err != nil || n < -(1<<31) || n > 1<<32-1 {
+			return nil, fmt.Errorf("invalid value %q", kv)
+		}
+
+		switch k[0] {
+		case 'a':
+			c.action = byte(n)
+		case 'q':
+			c.quiet = int(n)
+		case 'f':
+			c.format = int(n)
+		case 't':
+			c.medium = byte(n)
+		case 's':
+			c.width = int(n)
+		case 'v':
+			c.height = int(n)
+		case 'S':
+			c.size = int(n)
+		case 'O':
+			c.offset = int(n)
+		case 'o':
+			c.compress = byte(n)
+		case 'i':
+			c.id = uint32(n)
+		case 'I':
+			c.number = uint32(n)
+		case 'p':
+			c.pid = uint32(n)
+		case 'm':
+			c.more = n == 1
+		case 'x':
+			c.x = int(n)
+		case 'y':
+			c.y = int(n)
+		case 'w':
+			c.w = int(n)
+		case 'h':
+			c.h = int(n)
+		case 'c':
+			c.cols = int(n)
+		case 'r':
+			c.rows = int(n)
+		case 'z':
+			c.z = int(n)
+		case 'C':
+			c.nomove = n == 1
+		case 'd':
+			c.del = byte(n)
+		}
+	}
+	return c, nil
+}
+
+// kittyreply answers the client unless it asked to be quiet or
+// didn't identify the image
+func kittyreply(c *KittyCmd, err error) {
+	if c.id == 0 && c.number == 0 {
+		return
+	}
+	if (err == nil && c.quiet >= 1) || c.quiet >= 2 {
+		return
+	}
+
+	msg := "OK"
+	if err != nil {
+		msg = err.Error()
+		if !strings.Contains(msg, ":") {
+			msg = "EINVAL:" + msg
+		}
+	}
+
+	buf := "\033_G"
+	if c.id != 0 {
+		buf += fmt.Sprintf("i=%d", c.id)
+	}
+	if c.number != 0 {
+		if c.id != 0 {
+			buf += ","
+		}
+		buf += fmt.Sprintf("I=%d", c.number)
+	}
+	if c.pid != 0 {
+		buf += fmt.Sprintf(",p=%d", c.pid)
+	}
+	buf += ";" + msg + "\033\\"
+	ttywrite([]byte(buf), false)
+}
+
+// kittyread reads the data of a file, temporary file or shared memory
+// object named by the payload
+func kittyread(c *KittyCmd, name []byte) ([]byte, error) {
+	path := string(name)
+	switch c.medium {
+	case 't':
+		// only remove what looks like it was made for us
+		if !strings.Contains(path, "tty-graphics-protocol") ||
+			!strings.HasPrefix(filepath.Clean(path), filepath.Clean(os.TempDir())+"/") {
+			return nil, errors.New("EPERM:not a temporary file")
+		}
+	case 's':
+		if strings.ContainsRune(path, '/') {
+			return nil, errors.New("EINVAL:bad shared memory name")
+		}
+		path = filepath.Join("/dev/shm", path)
+	}
+
+	// a fifo would block the main loop, a link point anywhere
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("EBADF:%v", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, errors.New("EBADF:not a regular file")
+	}
+	if _, err := f.Seek(int64(c.offset), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("EBADF:%v", err)
+	}
+	size := int64(KITTY_MAX_DATA)
+	if c.size > 0 && int64(c.size) < size {
+		size = int64(c.size)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, size))
+	if err != nil {
+		return nil, fmt.Errorf("EBADF:%v", err)
+	}
+	if c.medium != 'f' {
+		os.Remove(path)
+	}
+	return data, nil
+}
+
+func kittydecode(c *KittyCmd, data []byte) (image.Image, error) {
+	if c.medium != 'd' {
+		var err error
+		data, err = kittyread(c, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.compress == 'z' {
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("EINVAL:%v", err)
+		}
+		data, err = io.ReadAll(io.LimitReader(r, KITTY_MAX_DATA))
+		if err != nil {
+			return nil, fmt.Errorf("EINVAL:%v", err)
+		}
+	}
+
+	switch c.format {
+	case 100:
+		img, err := imgdecode(data)
+		if err != nil {
+			return nil, fmt.Errorf("EBADPNG:%v", err)
+		}
+		return img, nil
+	case 24, 32:
+		bpp := c.format / 8
+		if c.width <= 0 || c.height <= 0 || c.width*c.height > IMG_MAX_PIXELS {
+			return nil, errors.New("EINVAL:bad image size")
+		}
+		if len(data) < c.width*c.height*bpp {
+			return nil, errors.New("ENODATA:insufficient image data")
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, c.width, c.height))
+		for i := 0; i < c.width*c.height; i++ {
+			p := img.Pix[i*4:]
+			copy(p, data[i*bpp:i*bpp+3])
+			p[3] = 0xff
+			if bpp == 4 {
+				p[3] = data[i*bpp+3]
+			}
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("EINVAL:unknown format %d", c.format)
+}
+
+func kittyfind(c *KittyCmd) *KittyImage {
+	if c.id != 0 {
+		return kittyimages[c.id]
+	}
+	// the newest image with that number
+	var k *KittyImage
+	for _, i := range kittyimages {
+		if i.number == c.number && (k == nil || i.id > k.id) {
+			k = i
+		}
+	}
+	return k
+}
+
+func kittytransmit(c *KittyCmd, data []byte) (*KittyImage, error) {
+	if c.id != 0 && c.number != 0 {
+		return nil, errors.New("EINVAL:both i and I given")
+	}
+
+	img, err := kittydecode(c, data)
+	if err != nil {
+		return nil, err
+	}
+	if c.action == 'q' {
+		return nil, nil
+	}
+
+	k := &KittyImage{
+		id:     c.id,
+		number: c.number,
+		img:    img,
+		size:   imgsize(img),
+		used:   imgstamp(),
+	}
+	if k.size > imgmaxstorage {
+		return nil, errors.New("EFBIG:image too large")
+	}
+	if k.id == 0 {
+		k.id = kittynextid
+		kittynextid++
+	}
+	// a new image with the same id replaces the old one and its placements
+	kittyfree(k.id)
+	imgquota(k.size, nil)
+	kittyimages[k.id] = k
+	imgstored += k.size
+	return k, nil
+}
+
+// kittyfree forgets the image id and erases its placements
+func kittyfree(id uint32) {
+	k := kittyimages[id]
+	if k == nil {
+		return
+	}
+	kittydelete(func(p *Placement) bool { return p.id == id })
+	for pid, p := range placements {
+		if p.id == id {
+			imgdrop(pid)
+		}
+	}
+	delete(kittyimages, id)
+	imgstored -= k.size
+}
+
+func kittyput(c *KittyCmd, k *KittyImage) error {
+	img := k.img
+	k.placed = true
+	k.used = imgstamp()
+	if c.w > 0 || c.h > 0 || c.x > 0 || c.y > 0 {
+		r := image.Rect(c.x, c.y, c.x+c.w, c.y+c.h)
+		if c.w == 0 {
+			r.Max.X = img.Bounds().Max.X
+		}
+		if c.h == 0 {
+			r.Max.Y = img.Bounds().Max.Y
+		}
+		sub, ok := img.(interface {
+			SubImage(image.Rectangle) image.Image
+		})
+		if !ok || r.Intersect(img.Bounds()).Empty() {
+			return errors.New("EINVAL:bad source rectangle")
+		}
+		img = sub.SubImage(r.Intersect(img.Bounds()))
+	}
+
+	cols, rows := -1, -1
+	if c.cols > 0 {
+		cols = c.cols
+	}
+	if c.rows > 0 {
+		rows = c.rows
+	}
+	cols, rows = imgfit(img, cols, rows, true)
+
+	// placing again with the same placement id moves it
+	if c.pid != 0 {
+		kittydelete(func(p *Placement) bool { return p.id == k.id && p.pid == c.pid })
+	}
+
+	cursor := term.c
+	tplaceimage(&Placement{
+		img:  img,
+		cols: cols,
+		rows: rows,
+		z:    c.z,
+		id:   k.id,
+		pid:  c.pid,
+	})
+	if c.nomove {
+		term.c = cursor
+	}
+	return nil
+}
+
+// kittydelete erases the cells of the screen showing the placements
+// selected by f, it returns the ids of their images
+func kittydelete(f func(*Placement) bool) map[uint32]bool {
+	ids := map[uint32]bool{}
+	for y := 0; y < term.row; y++ {
+		for x := 0; x < term.col; x++ {
+			g := &term.line[y][x]
+			if g.img == 0 {
+				continue
+			}
+			p := placements[g.img]
+			if p == nil || !f(p) {
+				continue
+			}
+			ids[p.id] = true
+			g.img = 0
+			term.dirty[y] = true
+		}
+	}
+	return ids
+}
+
+func kittydel(c *KittyCmd) {
+	cx, cy := term.c.x, term.c.y
+	var f func(x, y int, p *Placement) bool
+	switch c.del | 0x20 {
+	case 'a', 0x20:
+		f = func(x, y int, p *Placement) bool { return true }
+	case 'i':
+		f = func(x, y int, p *Placement) bool {
+			return p.id == c.id && (c.pid == 0 || p.pid == c.pid)
+		}
+	case 'n':
+		k := kittyfind(c)
+		f = func(x, y int, p *Placement) bool {
+			return k != nil && p.id == k.id && (c.pid == 0 || p.pid == c.pid)
+		}
+	case 'c':
+		f = func(x, y int, p *Placement) bool { return x == cx && y == cy }
+	case 'p':
+		f = func(x, y int, p *Placement) bool { return x == c.x-1 && y == c.y-1 }
+	case 'q':
+		f = func(x, y int, p *Placement) bool { return x == c.x-1 && y == c.y-1 && p.z == c.z }
+	case 'x':
+		f = func(x, y int, p *Placement) bool { return x == c.x-1 }
+	case 'y':
+		f = func(x, y int, p *Placement) bool { return y == c.y-1 }
+	case 'z':
+		f = func(x, y int, p *Placement) bool { return p.z == c.z }
+	default:
+		fmt.Fprintf(os.Stderr, "erresc: unknown kitty graphics delete %q\n", c.del)
+		return
+	}
+
+	// find the placements touching the selected cells, then erase
+	// all of their cells
+	hit := map[*Placement]bool{}
+	for y := 0; y < term.row; y++ {
+		for x := 0; x < term.col; x++ {
+			g := term.line[y][x]
+			if p := placements[g.img]; g.img != 0 && p != nil && p.id != 0 && f(x, y, p) {
+				hit[p] = true
+			}
+		}
+	}
+	ids := kittydelete(func(p *Placement) bool { return hit[p] })
+
+	// upper case also frees the image data
+	if c.del != 0 && c.del&0x20 == 0 {
+		for id := range ids {
+			kittyfree(id)
+		}
+	}
+}
+
+// kittygraphics handles the APC G command
+func kittygraphics(p []byte) {
+	ctrl, payload, _ := bytes.Cut(p, []byte(";"))
+
+	c, err := kittyparse(ctrl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "erresc: kitty graphics: %v\n", err)
+		return
+	}
+
+	// the chunks after the first only carry m, the first has the keys
+	if kittypending != nil {
+		more := c.more
+		c = kittypending
+		c.more = more
+	}
+
+	var data []byte
+	if c.action == 't' || c.action == 'T' || c.action == 'q' {
+		dec, err := base64.StdEncoding.DecodeString(string(payload))
+		if err != nil {
+			kittypending, kittydata = nil, nil
+			kittyreply(c, errors.New("EINVAL:invalid base64"))
+			return
+		}
+		if len(kittydata)+len(dec) > KITTY_MAX_DATA {
+			kittypending, kittydata = nil, nil
+			kittyreply(c, errors.New("EFBIG:image data too large"))
+			return
+		}
+		kittydata = append(kittydata, dec...)
+		if c.more {
+			kittypending = c
+			return
+		}
+		data = kittydata
+		kittypending, kittydata = nil, nil
+	}
+
+	switch c.action {
+	case 't', 'q':
+		_, err = kittytransmit(c, data)
+		kittyreply(c, err)
+	case 'T':
+		var k *KittyImage
+		k, err = kittytransmit(c, data)
+		if err == nil {
+			err = kittyput(c, k)
+		}
+		kittyreply(c, err)
+	case 'p':
+		k := kittyfind(c)
+		if k == nil {
+			kittyreply(c, errors.New("ENOENT:image not found"))
+			return
+		}
+		kittyreply(c, kittyput(c, k))
+	case 'd':
+		kittydel(c)
+	default:
+		fmt.Fprintf(os.Stderr, "erresc: unknown kitty graphics action %q\n", c.action)
+	}
+}
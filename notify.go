@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Desktop notifications requested by the application through
+// OSC 9 (iTerm2), OSC 777 (urxvt) and OSC 99 (kitty).
+
+const NOTIFY_MAX_LEN = 1024
+
+type Notification struct {
+	title []byte
+	body  []byte
+}
+
+var (
+	notifypending = map[string]*Notification{} // OSC 99 notifications being transferred
+	notifytokens  = notifyburst                // rate limiting tokens left
+	notifylast    time.Time                    // last time a token was refilled
+	notifyqueue   chan Notification            // to notifyrun
+	notifyfailed  = make(chan struct{}, 1)     // a notification could not be shown
+)
+
+// notifyallow implements a token bucket so hostile output can't flood the
+// desktop with notifications
+func notifyallow() bool {
+	now := time.Now()
+	if notifyrate > 0 {
+		n := int(now.Sub(notifylast) / notifyrate)
+		if n > 0 {
+			notifytokens = min(notifytokens+n, notifyburst)
+			notifylast = notifylast.Add(time.Duration(n) * notifyrate)
+		}
+	}
+	if notifytokens == 0 {
+		return false
+	}
+	notifytokens--
+	return true
+}
+
+// notifysanitize strips control characters and limits the length of
+// the text shown to the user
+func notifysanitize(s []byte) string {
+	s = []byte(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' {
+			return -1
+		}
+		return r
+	}, string(s)))
+	if len(s) > NOTIFY_MAX_LEN {
+		s = s[:NOTIFY_MAX_LEN]
+	}
+	return strings.ToValidUTF8(string(s), "")
+}
+
+func tnotify(title, body []byte) {
+	if !notifyallow() {
+		fmt.Fprintln(os.Stderr, "notify: too many notifications, dropping")
+		return
+	}
+
+	t := notifysanitize(title)
+	b := notifysanitize(body)
+	if t == "" {
+		t, b = b, ""
+	}
+	if t == "" {
+		return
+	}
+
+	if len(notifycmd) == 0 {
+		notifydbus(t, b)
+		return
+	}
+	args := append(append([]string{}, notifycmd[1:]...), t, b)
+	exe := exec.Command(notifycmd[0], args...)
+	if err := exe.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "notify: can't run %s: %v\n", notifycmd[0], err)
+		notifyurgent()
+		return
+	}
+	go exe.Wait()
+}
+
+// notifyurgent falls back to the window manager urgency hint
+func notifyurgent() {
+	if win.mode&MODE_FOCUSED == 0 {
+		xseturgency(true)
+	}
+}
+
+// notifydbus queues a notification for notifyrun, started on first use
+func notifydbus(title, body string) {
+	if notifyqueue == nil {
+		notifyqueue = make(chan Notification, 16)
+		go notifyrun(notifyqueue)
+	}
+	select {
+	case notifyqueue <- Notification{[]byte(title), []byte(body)}:
+	default:
+		fmt.Fprintln(os.Stderr, "notify: too many notifications, dropping")
+	}
+}
+
+// notifyrun sends the notifications of q over D-Bus. It runs on its own
+// as connecting may launch the bus, the failures go to notifyfailed for
+// the main loop to fall back.
+func notifyrun(q chan Notification) {
+	conn, connerr := dbus.SessionBus()
+	for n := range q {
+		err := connerr
+		if err == nil {
+			obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+			err = obj.Call("org.freedesktop.Notifications.Notify", 0,
+				"st", uint32(0), "", string(n.title), string(n.body),
+				[]string{}, map[string]dbus.Variant{}, int32(-1)).Err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "notify: %v\n", err)
+			select {
+			case notifyfailed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notifykitty handles the OSC 99 protocol: 99 ; key=value:... ; payload
+// A notification may be sent in several chunks with the same identifier,
+// it is shown once a chunk without d=0 arrives.
+func notifykitty(meta, payload []byte) {
+	id := ""
+	done := true
+	part := "title"
+	encoded := false
+	for _, kv := range strings.Split(string(meta), ":") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "i":
+			id = v
+		case "d":
+			done = v != "0"
+		case "p":
+			part = v
+		case "e":
+			encoded = v == "1"
+		}
+	}
+
+	if encoded {
+		dec, err := base64.StdEncoding.DecodeString(string(payload))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "erresc: invalid base64")
+			return
+		}
+		payload = dec
+	}
+
+	n := notifypending[id]
+	if n == nil {
+		if len(notifypending) >= 16 {
+			// forget about transfers that never completed
+			notifypending = map[string]*Notification{}
+		}
+		n = &Notification{}
+		notifypending[id] = n
+	}
+	switch part {
+	case "title":
+		n.title = append(n.title, payload...)
+	case "body":
+		n.body = append(n.body, payload...)
+	}
+	if len(n.title)+len(n.body) > 2*NOTIFY_MAX_LEN {
+		delete(notifypending, id)
+		fmt.Fprintln(os.Stderr, "erresc: notification too long")
+		return
+	}
+
+	if done {
+		delete(notifypending, id)
+		tnotify(n.title, n.body)
+	}
+}
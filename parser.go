@@ -0,0 +1,236 @@
+package main
+
+// The escape sequence parser is the state machine of the DEC VT500
+// series described by Paul Williams (https://vt100.net/emu/dec_ansi_parser)
+// with the usual extensions: colons separate sub-parameters, BEL ends
+// strings like ST does, and ESC k starts the old title string.
+
+const (
+	VT_GROUND = iota
+	VT_ESCAPE
+	VT_ESCAPE_INTERMEDIATE
+	VT_CSI_ENTRY
+	VT_CSI_PARAM
+	VT_CSI_INTERMEDIATE
+	VT_CSI_IGNORE
+	VT_DCS_ENTRY
+	VT_DCS_PARAM
+	VT_DCS_INTERMEDIATE
+	VT_DCS_PASSTHROUGH
+	VT_DCS_IGNORE
+	VT_OSC_STRING
+	VT_SOS_PM_APC_STRING
+	VT_NSTATE
+)
+
+const (
+	VT_IGNORE = iota
+	VT_PRINT
+	VT_EXECUTE
+	VT_COLLECT
+	VT_PARAM
+	VT_ESC_DISPATCH
+	VT_CSI_DISPATCH
+	VT_HOOK
+	VT_PUT
+	VT_STR_START
+	VT_STR_PUT
+	VT_STR_END
+)
+
+const VT_INTER_MAX = 4 // intermediates kept, longer sequences are unknown anyway
+
+type VTTransition struct {
+	action uint8
+	state  uint8
+}
+
+type VTParser struct {
+	state  int
+	inter  []byte // intermediate characters of the ESC sequence
+	strend bool   // a string was ended by ESC, ST if a backslash follows
+}
+
+// transitions for the 7-bit and C1 characters, the others are printed
+// in the ground state, kept in strings and ignored in sequences
+var vttable [VT_NSTATE][0xa0]VTTransition
+
+func vtrange(state int, from, to rune, action, next int) {
+	for c := from; c <= to; c++ {
+		vttable[state][c] = VTTransition{uint8(action), uint8(next)}
+	}
+}
+
+func init() {
+	for s := 0; s < VT_NSTATE; s++ {
+		vtrange(s, 0x00, 0x1f, VT_EXECUTE, s)
+		vtrange(s, 0x20, 0x7f, VT_IGNORE, s)
+	}
+
+	vtrange(VT_GROUND, 0x20, 0x7e, VT_PRINT, VT_GROUND)
+
+	vtrange(VT_ESCAPE, 0x20, 0x2f, VT_COLLECT, VT_ESCAPE_INTERMEDIATE)
+	vtrange(VT_ESCAPE, 0x30, 0x7e, VT_ESC_DISPATCH, VT_GROUND)
+	vtrange(VT_ESCAPE, '[', '[', VT_IGNORE, VT_CSI_ENTRY)
+	vtrange(VT_ESCAPE, 'P', 'P', VT_IGNORE, VT_DCS_ENTRY)
+	vtrange(VT_ESCAPE, ']', ']', VT_STR_START, VT_OSC_STRING)
+	for _, c := range "X^_k" {
+		vtrange(VT_ESCAPE, c, c, VT_STR_START, VT_SOS_PM_APC_STRING)
+	}
+
+	vtrange(VT_ESCAPE_INTERMEDIATE, 0x20, 0x2f, VT_COLLECT, VT_ESCAPE_INTERMEDIATE)
+	vtrange(VT_ESCAPE_INTERMEDIATE, 0x30, 0x7e, VT_ESC_DISPATCH, VT_GROUND)
+
+	vtrange(VT_CSI_ENTRY, 0x20, 0x2f, VT_COLLECT, VT_CSI_INTERMEDIATE)
+	vtrange(VT_CSI_ENTRY, 0x30, 0x3b, VT_PARAM, VT_CSI_PARAM)
+	vtrange(VT_CSI_ENTRY, 0x3c, 0x3f, VT_COLLECT, VT_CSI_PARAM)
+	vtrange(VT_CSI_ENTRY, 0x40, 0x7e, VT_CSI_DISPATCH, VT_GROUND)
+
+	vtrange(VT_CSI_PARAM, 0x20, 0x2f, VT_COLLECT, VT_CSI_INTERMEDIATE)
+	vtrange(VT_CSI_PARAM, 0x30, 0x3b, VT_PARAM, VT_CSI_PARAM)
+	vtrange(VT_CSI_PARAM, 0x3c, 0x3f, VT_IGNORE, VT_CSI_IGNORE)
+	vtrange(VT_CSI_PARAM, 0x40, 0x7e, VT_CSI_DISPATCH, VT_GROUND)
+
+	vtrange(VT_CSI_INTERMEDIATE, 0x20, 0x2f, VT_COLLECT, VT_CSI_INTERMEDIATE)
+	vtrange(VT_CSI_INTERMEDIATE, 0x30, 0x3f, VT_IGNORE, VT_CSI_IGNORE)
+	vtrange(VT_CSI_INTERMEDIATE, 0x40, 0x7e, VT_CSI_DISPATCH, VT_GROUND)
+
+	vtrange(VT_CSI_IGNORE, 0x40, 0x7e, VT_IGNORE, VT_GROUND)
+
+	// the DCS header is kept with the data for strhandle
+	for _, s := range []int{VT_DCS_ENTRY, VT_DCS_PARAM, VT_DCS_INTERMEDIATE, VT_DCS_IGNORE} {
+		vtrange(s, 0x00, 0x1f, VT_IGNORE, s)
+	}
+	vtrange(VT_DCS_ENTRY, 0x20, 0x2f, VT_STR_PUT, VT_DCS_INTERMEDIATE)
+	vtrange(VT_DCS_ENTRY, 0x30, 0x3f, VT_STR_PUT, VT_DCS_PARAM)
+	vtrange(VT_DCS_ENTRY, 0x40, 0x7e, VT_HOOK, VT_DCS_PASSTHROUGH)
+
+	vtrange(VT_DCS_PARAM, 0x20, 0x2f, VT_STR_PUT, VT_DCS_INTERMEDIATE)
+	vtrange(VT_DCS_PARAM, 0x30, 0x3b, VT_STR_PUT, VT_DCS_PARAM)
+	vtrange(VT_DCS_PARAM, 0x3c, 0x3f, VT_IGNORE, VT_DCS_IGNORE)
+	vtrange(VT_DCS_PARAM, 0x40, 0x7e, VT_HOOK, VT_DCS_PASSTHROUGH)
+
+	vtrange(VT_DCS_INTERMEDIATE, 0x20, 0x2f, VT_STR_PUT, VT_DCS_INTERMEDIATE)
+	vtrange(VT_DCS_INTERMEDIATE, 0x30, 0x3f, VT_IGNORE, VT_DCS_IGNORE)
+	vtrange(VT_DCS_INTERMEDIATE, 0x40, 0x7e, VT_HOOK, VT_DCS_PASSTHROUGH)
+
+	vtrange(VT_DCS_PASSTHROUGH, 0x00, 0x7f, VT_PUT, VT_DCS_PASSTHROUGH)
+
+	// control characters are part of the strings, as they always were
+	vtrange(VT_OSC_STRING, 0x00, 0x7f, VT_STR_PUT, VT_OSC_STRING)
+	vtrange(VT_SOS_PM_APC_STRING, 0x00, 0x7f, VT_STR_PUT, VT_SOS_PM_APC_STRING)
+
+	// transitions from anywhere
+	for s := 0; s < VT_NSTATE; s++ {
+		vtrange(s, 0x18, 0x18, VT_EXECUTE, VT_GROUND) // CAN
+		vtrange(s, 0x1a, 0x1a, VT_EXECUTE, VT_GROUND) // SUB
+		vtrange(s, 0x1b, 0x1b, VT_IGNORE, VT_ESCAPE)
+		vtrange(s, 0x80, 0x9f, VT_EXECUTE, VT_GROUND)
+		vtrange(s, 0x90, 0x90, VT_IGNORE, VT_DCS_ENTRY)
+		vtrange(s, 0x9b, 0x9b, VT_IGNORE, VT_CSI_ENTRY)
+		vtrange(s, 0x9d, 0x9d, VT_STR_START, VT_OSC_STRING)
+		for _, c := range []rune{0x98, 0x9e, 0x9f} {
+			vtrange(s, c, c, VT_STR_START, VT_SOS_PM_APC_STRING)
+		}
+		vtrange(s, 0x9c, 0x9c, VT_IGNORE, VT_GROUND) // ST
+	}
+
+	// ST ends the strings, and so does BEL for compatibility with xterm
+	for s := VT_DCS_ENTRY; s < VT_NSTATE; s++ {
+		vtrange(s, '\a', '\a', VT_STR_END, VT_GROUND)
+		vtrange(s, 0x9c, 0x9c, VT_STR_END, VT_GROUND)
+	}
+	vtrange(VT_DCS_IGNORE, '\a', '\a', VT_IGNORE, VT_GROUND)
+	vtrange(VT_DCS_IGNORE, 0x9c, 0x9c, VT_IGNORE, VT_GROUND)
+}
+
+func vtisstr(state int) bool {
+	return state == VT_DCS_PASSTHROUGH || state == VT_OSC_STRING || state == VT_SOS_PM_APC_STRING
+}
+
+func vtparse(u rune, width int) {
+	vt := &term.vt
+
+	var t VTTransition
+	switch {
+	case u < 0xa0:
+		t = vttable[vt.state][u]
+	case vt.state == VT_GROUND:
+		t = VTTransition{VT_PRINT, VT_GROUND}
+	case vt.state == VT_DCS_PASSTHROUGH:
+		t = VTTransition{VT_PUT, VT_DCS_PASSTHROUGH}
+	case vtisstr(vt.state):
+		t = VTTransition{VT_STR_PUT, uint8(vt.state)}
+	default:
+		t = VTTransition{VT_IGNORE, uint8(vt.state)}
+	}
+
+	if VT_CSI_ENTRY <= vt.state && vt.state <= VT_CSI_IGNORE && 0x20 <= u && u < 0x7f {
+		if len(csiescseq.buf) < ESC_BUF_SIZ {
+			csiescseq.buf = append(csiescseq.buf, byte(u))
+		}
+	}
+
+	vtaction(int(t.action), u, width)
+
+	// ESC and the C1 introducers restart a sequence even from its own state
+	next := int(t.state)
+	if next == vt.state && u != 033 && !(0x80 <= u && u < 0xa0) {
+		return
+	}
+
+	// leave
+	if vt.state == VT_DCS_PASSTHROUGH {
+		term.mode &^= MODE_SIXEL
+	}
+	vt.strend = u == 033 && vtisstr(vt.state)
+
+	// enter
+	vt.state = next
+	switch next {
+	case VT_ESCAPE:
+		vt.inter = vt.inter[:0]
+	case VT_CSI_ENTRY:
+		csireset()
+	case VT_DCS_ENTRY:
+		tstrsequence(0x90)
+	}
+}
+
+func vtaction(action int, u rune, width int) {
+	switch action {
+	case VT_PRINT:
+		tputglyph(u, width)
+	case VT_EXECUTE:
+		tcontrolcode(u)
+	case VT_COLLECT:
+		if term.vt.state == VT_ESCAPE || term.vt.state == VT_ESCAPE_INTERMEDIATE {
+			if len(term.vt.inter) < VT_INTER_MAX {
+				term.vt.inter = append(term.vt.inter, byte(u))
+			}
+		} else {
+			csicollect(u)
+		}
+	case VT_PARAM:
+		csiparam(u)
+	case VT_ESC_DISPATCH:
+		escdispatch(u)
+	case VT_CSI_DISPATCH:
+		csidispatch(u)
+	case VT_HOOK:
+		strput(u)
+		if u == 'q' {
+			term.mode |= MODE_SIXEL
+		}
+	case VT_PUT:
+		if term.mode&MODE_SIXEL == 0 {
+			strput(u)
+		}
+	case VT_STR_START:
+		tstrsequence(u)
+	case VT_STR_PUT:
+		strput(u)
+	case VT_STR_END:
+		strhandle()
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Piping of the text of the view, or of the whole history, to a command
+// such as a URL picker. The command runs on its own, its output comes
+// back through piperead for the main loop to paste.
+
+type ExternalPipe struct {
+	cmd   []string
+	hist  bool // the history too, not only the view
+	reply bool // write the output of the command to the tty
+}
+
+var piperead = make(chan []byte)
+
+// tpipetext returns the text of the n lines from line i, counted from
+// the oldest line in history, the lines wrapping are joined
+func tpipetext(i, n int) []byte {
+	var b []byte
+	for end := i + n; i < end; i++ {
+		l := thistline(i)
+		b = tappendline(b, l)
+		if l[term.col-1].mode&ATTR_WRAP == 0 {
+			b = append(b, '\n')
+		}
+	}
+	return b
+}
+
+func externalpipe(arg interface{}) {
+	p := arg.(ExternalPipe)
+	if len(p.cmd) == 0 {
+		return
+	}
+
+	var in []byte
+	if p.hist {
+		in = tpipetext(0, term.histn+term.row)
+	} else {
+		in = tpipetext(term.histn-term.scr, term.row)
+	}
+
+	var out bytes.Buffer
+	exe := exec.Command(p.cmd[0], p.cmd[1:]...)
+	exe.Stdin = bytes.NewReader(in)
+	exe.Stderr = os.Stderr
+	if p.reply {
+		exe.Stdout = &out
+	}
+	if err := exe.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "externalpipe: can't start %s: %v\n", p.cmd[0], err)
+		return
+	}
+
+	go func() {
+		// a picker exits with an error when nothing was picked
+		if exe.Wait() != nil || !p.reply {
+			return
+		}
+		if b := bytes.TrimSuffix(out.Bytes(), []byte("\n")); len(b) > 0 {
+			piperead <- b
+		}
+	}()
+}
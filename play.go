@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Replay of asciicast (v1 and v2) and ttyrec recordings in place of a
+// shell. The player is driven from the main loop, which calls playrun
+// on every iteration to write the events that are due.
+
+type PlayEvent struct {
+	t        time.Duration
+	data     []byte // output, nil for a resize
+	col, row int
+}
+
+type Player struct {
+	ev       []PlayEvent
+	col, row int // recorded size, 0 if unknown
+	i        int // next event
+	pos      time.Duration
+	last     time.Time
+	speed    float64
+	paused   bool
+}
+
+var player *Player
+
+func playopen(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	p := &Player{speed: 1}
+	if bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("{")) {
+		err = castload(p, b)
+	} else {
+		err = ttyrecload(p, b)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	player = p
+	return nil
+}
+
+func castload(p *Player, b []byte) error {
+	var hdr struct {
+		Version int
+		Width   int
+		Height  int
+		Stdout  [][2]interface{} // v1 frames, [delay, data]
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(&hdr); err != nil {
+		return err
+	}
+	p.col, p.row = hdr.Width, hdr.Height
+
+	switch hdr.Version {
+	case 1:
+		var t float64
+		for _, f := range hdr.Stdout {
+			d, _ := f[0].(float64)
+			s, _ := f[1].(string)
+			t += d
+			p.ev = append(p.ev, PlayEvent{t: secs(t), data: []byte(s)})
+		}
+	case 2:
+		for {
+			var ev []interface{}
+			err := dec.Decode(&ev)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if len(ev) < 3 {
+				continue
+			}
+			t, _ := ev[0].(float64)
+			code, _ := ev[1].(string)
+			s, _ := ev[2].(string)
+			switch code {
+			case "o":
+				p.ev = append(p.ev, PlayEvent{t: secs(t), data: []byte(s)})
+			case "r":
+				var col, row int
+				if n, _ := fmt.Sscanf(s, "%dx%d", &col, &row); n == 2 && col > 0 && row > 0 {
+					p.ev = append(p.ev, PlayEvent{t: secs(t), col: col, row: row})
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("asciicast version %d not supported", hdr.Version)
+	}
+	return nil
+}
+
+// ttyrec frames are a little endian header of seconds, microseconds
+// and length followed by the data
+func ttyrecload(p *Player, b []byte) error {
+	var start time.Duration
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return errors.New("truncated ttyrec header")
+		}
+		sec := binary.LittleEndian.Uint32(b)
+		usec := binary.LittleEndian.Uint32(b[4:])
+		n := binary.LittleEndian.Uint32(b[8:])
+		b = b[12:]
+		if uint32(len(b)) < n {
+			return errors.New("truncated ttyrec frame")
+		}
+
+		t := time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond
+		if len(p.ev) == 0 {
+			start = t
+		}
+		if t < start {
+			t = start
+		}
+		p.ev = append(p.ev, PlayEvent{t: t - start, data: b[:n]})
+		b = b[n:]
+	}
+	return nil
+}
+
+func secs(t float64) time.Duration {
+	return time.Duration(t * float64(time.Second))
+}
+
+// playstart sets the recorded size and starts the clock
+func playstart() {
+	if player.col > 0 && player.row > 0 {
+		xsetsize(player.col, player.row)
+	}
+	player.last = time.Now()
+}
+
+// playrun writes the events due since the last call, it returns
+// whether anything was written
+func playrun() bool {
+	p := player
+	now := time.Now()
+	if !p.paused {
+		p.pos += time.Duration(float64(now.Sub(p.last)) * p.speed)
+	}
+	p.last = now
+	return playto(p.pos)
+}
+
+func playto(pos time.Duration) bool {
+	p := player
+	i := p.i
+	for ; p.i < len(p.ev) && p.ev[p.i].t <= pos; p.i++ {
+		e := &p.ev[p.i]
+		if e.data == nil {
+			xsetsize(e.col, e.row)
+		} else {
+			ttyfeed(e.data)
+		}
+	}
+	return p.i != i
+}
+
+// playseek moves to the given position, going back means playing the
+// recording again from a reset terminal
+func playseek(pos time.Duration) {
+	p := player
+	if pos < 0 {
+		pos = 0
+	}
+	if pos < p.pos {
+		selclear()
+		// a new history too
+		tnew(term.col, term.row)
+		imgreset()
+		resettitle()
+		xloadcols()
+		xsetmode(false, MODE_APPKEYPAD|MODE_MOUSE|MODE_MOUSESGR|MODE_REVERSE|
+			MODE_KBDLOCK|MODE_HIDE|MODE_APPCURSOR|MODE_FOCUS|MODE_BRCKTPASTE)
+		xsetpointermotion(false)
+		xsetcursor(cursorshape)
+		if p.col > 0 && p.row > 0 {
+			xsetsize(p.col, p.row)
+		}
+		p.i = 0
+	}
+	p.pos = pos
+	playto(pos)
+	tfulldirt()
+}
+
+func playpause(interface{}) {
+	if player == nil {
+		return
+	}
+	player.paused = !player.paused
+}
+
+// playstep pauses and plays the next event
+func playstep(interface{}) {
+	p := player
+	if p == nil {
+		return
+	}
+	p.paused = true
+	if p.i < len(p.ev) {
+		p.pos = p.ev[p.i].t
+		playto(p.pos)
+	}
+}
+
+// playspeed multiplies the speed by arg, 0 resets it
+func playspeed(arg interface{}) {
+	if player == nil {
+		return
+	}
+	f := arg.(float64)
+	if f == 0 {
+		player.speed = 1
+		return
+	}
+	player.speed *= f
+	if player.speed < 1.0/16 {
+		player.speed = 1.0 / 16
+	} else if player.speed > 64 {
+		player.speed = 64
+	}
+}
+
+// playskip seeks arg seconds forward, or backward if negative
+func playskip(arg interface{}) {
+	if player == nil {
+		return
+	}
+	playseek(player.pos + secs(arg.(float64)))
+}
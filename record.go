@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Session recording in the asciicast v2 format: a header line followed
+// by one JSON array per event, [time, code, data], where the code is
+// "o" for output, "i" for input and "r" for a resize to "COLSxROWS".
+
+type Recorder struct {
+	f       *os.File
+	start   time.Time
+	pending [2][]byte // incomplete utf8 of the output and input
+}
+
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env"`
+}
+
+var (
+	rec   *Recorder
+	recmu sync.Mutex // output is recorded from the tty reader
+)
+
+func recopen(path string, col, row int) error {
+	// the input typed may be in it, passwords included
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	r := &Recorder{f: f, start: time.Now()}
+	hdr, _ := json.Marshal(CastHeader{
+		Version:   2,
+		Width:     col,
+		Height:    row,
+		Timestamp: r.start.Unix(),
+		Env: map[string]string{
+			"SHELL": os.Getenv("SHELL"),
+			"TERM":  termname,
+		},
+	})
+	if _, err := f.Write(append(hdr, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	recmu.Lock()
+	rec = r
+	recmu.Unlock()
+	return nil
+}
+
+// recevent writes an event, recmu is held
+func recevent(code string, data string) {
+	t := time.Since(rec.start).Seconds()
+	ev, _ := json.Marshal(data)
+	_, err := fmt.Fprintf(rec.f, "[%.6f, %q, %s]\n", t, code, ev)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "record: %v, stopping\n", err)
+		rec.f.Close()
+		rec = nil
+	}
+}
+
+// recdata records a chunk of the stream, keeping a char split
+// between two chunks for the next one as the events must be utf8
+func recdata(code string, i int, b []byte) {
+	recmu.Lock()
+	defer recmu.Unlock()
+	if rec == nil {
+		return
+	}
+
+	b = append(rec.pending[i], b...)
+	n := len(b)
+	for j := max(0, n-utf8.UTFMax+1); j < n; j++ {
+		if utf8.RuneStart(b[j]) && !utf8.FullRune(b[j:]) {
+			n = j
+			break
+		}
+	}
+	rec.pending[i] = append([]byte(nil), b[n:]...)
+	if n > 0 {
+		recevent(code, string(b[:n]))
+	}
+}
+
+func recoutput(b []byte) {
+	recdata("o", 0, b)
+}
+
+// recinput records what the user typed or pasted
+func recinput(b []byte) {
+	if recordinput {
+		recdata("i", 1, b)
+	}
+}
+
+func recresize(col, row int) {
+	recmu.Lock()
+	defer recmu.Unlock()
+	if rec == nil {
+		return
+	}
+	recevent("r", fmt.Sprintf("%dx%d", col, row))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	xfont "golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/gofont/gomonobolditalic"
+	"golang.org/x/image/font/gofont/gomonoitalic"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Headless rendering of the screen to an image, for the places without
+// an X server. The Go Mono fonts stand in for the configured font and
+// the colors follow xloadcolor and xdrawglyphfontspecs.
+
+type Renderer struct {
+	face   [4]xfont.Face // regular, bold, italic, bold italic
+	cw, ch int
+	ascent int
+	pal    []color.RGBA
+}
+
+func rendernew(size float64) (*Renderer, error) {
+	r := &Renderer{}
+	ttfs := [][]byte{gomono.TTF, gomonobold.TTF, gomonoitalic.TTF, gomonobolditalic.TTF}
+	for i, ttf := range ttfs {
+		f, err := opentype.Parse(ttf)
+		if err != nil {
+			return nil, err
+		}
+		r.face[i], err = opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: xfont.HintingFull,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := r.face[0].Metrics()
+	adv, _ := r.face[0].GlyphAdvance('0')
+	r.cw = int(math.Ceil(float64(adv.Ceil()) * cwscale))
+	r.ch = int(math.Ceil(float64(m.Height.Ceil()) * chscale))
+	r.ascent = m.Ascent.Ceil()
+
+	var err error
+	r.pal, err = renderpalette()
+	return r, err
+}
+
+// renderpalette returns the colors of colorname and the 256 colors
+func renderpalette() ([]color.RGBA, error) {
+	pal := make([]color.RGBA, max(len(colorname), 256))
+	for i := range pal {
+		if 16 <= i && i <= 255 {
+			if i < 6*6*6+16 {
+				// same colors as xterm
+				pal[i] = color.RGBA{
+					uint8(sixd_to_16bit(((i-16)/36)%6) >> 8),
+					uint8(sixd_to_16bit(((i-16)/6)%6) >> 8),
+					uint8(sixd_to_16bit(((i-16)/1)%6) >> 8),
+					0xff,
+				}
+			} else {
+				// greyscale
+				v := uint8((0x0808 + 0x0a0a*(i-(6*6*6+16))) >> 8)
+				pal[i] = color.RGBA{v, v, v, 0xff}
+			}
+			continue
+		}
+		if i >= len(colorname) {
+			continue
+		}
+		c, ok := parsecolor(colorname[i])
+		if !ok {
+			return nil, fmt.Errorf("could not allocate color '%s'", colorname[i])
+		}
+		pal[i] = c
+	}
+	return pal, nil
+}
+
+// parsecolor understands the #RGB and rgb:R/G/B forms of XParseColor
+// and the names of the X colors used by colorname
+func parsecolor(name string) (color.RGBA, bool) {
+	name = strings.ToLower(strings.ReplaceAll(name, " ", ""))
+	switch {
+	case strings.HasPrefix(name, "#"):
+		h := name[1:]
+		n := len(h) / 3
+		if n == 0 || n > 4 || len(h) != 3*n {
+			break
+		}
+		var c [3]uint8
+		for i := range c {
+			v, err := strconv.ParseUint(h[i*n:(i+1)*n], 16, 16)
+			if err != nil {
+				return color.RGBA{}, false
+			}
+			// the digits are the most significant bits
+			c[i] = uint8(v << (16 - 4*n) >> 8)
+		}
+		return color.RGBA{c[0], c[1], c[2], 0xff}, true
+	case strings.HasPrefix(name, "rgb:"):
+		f := strings.Split(name[4:], "/")
+		if len(f) != 3 {
+			break
+		}
+		var c [3]uint8
+		for i, h := range f {
+			v, err := strconv.ParseUint(h, 16, 16)
+			if err != nil || len(h) == 0 || len(h) > 4 {
+				return color.RGBA{}, false
+			}
+			// the digits are scaled
+			c[i] = uint8(v * 255 / (1<<(4*len(h)) - 1))
+		}
+		return color.RGBA{c[0], c[1], c[2], 0xff}, true
+	case name == "black":
+		return color.RGBA{0, 0, 0, 0xff}, true
+	case name == "white":
+		return color.RGBA{0xff, 0xff, 0xff, 0xff}, true
+	case name == "gray" || name == "grey":
+		return color.RGBA{0xbe, 0xbe, 0xbe, 0xff}, true
+	case strings.HasPrefix(name, "gray") || strings.HasPrefix(name, "grey"):
+		n, err := strconv.Atoi(name[4:])
+		if err != nil || n < 0 || n > 100 {
+			break
+		}
+		v := uint8(float64(n)*2.55 + 0.5) // as rounded in rgb.txt
+		return color.RGBA{v, v, v, 0xff}, true
+	}
+
+	// red, red1 to red4, and so on
+	levels := map[byte]uint8{'1': 0xff, '2': 0xee, '3': 0xcd, '4': 0x8b}
+	hues := map[string][3]bool{
+		"red":     {true, false, false},
+		"green":   {false, true, false},
+		"blue":    {false, false, true},
+		"yellow":  {true, true, false},
+		"magenta": {true, false, true},
+		"cyan":    {false, true, true},
+	}
+	v := uint8(0xff)
+	if n := len(name); n > 0 && levels[name[n-1]] != 0 {
+		v = levels[name[n-1]]
+		name = name[:n-1]
+	}
+	hue, ok := hues[name]
+	if !ok {
+		return color.RGBA{}, false
+	}
+	c := color.RGBA{A: 0xff}
+	if hue[0] {
+		c.R = v
+	}
+	if hue[1] {
+		c.G = v
+	}
+	if hue[2] {
+		c.B = v
+	}
+	return c, true
+}
+
+// glyphcolors returns the colors a glyph is drawn with
+func glyphcolors(pal []color.RGBA, g Glyph) (fg, bg color.RGBA) {
+	col := func(c uint32) color.RGBA {
+		if istruecol(c) {
+			return color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 0xff}
+		}
+		if int(c) < len(pal) {
+			return pal[c]
+		}
+		return pal[defaultfg]
+	}
+
+	fg, bg = col(g.fg), col(g.bg)
+
+	// Change basic system colors [0-7] to bright system colors [8-15]
+	if g.mode&ATTR_BOLD_FAINT == ATTR_BOLD && g.fg <= 7 {
+		fg = pal[g.fg+8]
+	}
+	if g.mode&ATTR_BOLD_FAINT == ATTR_FAINT {
+		fg.R, fg.G, fg.B = fg.R/2, fg.G/2, fg.B/2
+	}
+	if g.mode&ATTR_REVERSE != 0 {
+		fg, bg = bg, fg
+	}
+	if g.mode&ATTR_INVISIBLE != 0 {
+		fg = bg
+	}
+	return fg, bg
+}
+
+// renderscreen draws the view without the cursor
+func renderscreen(r *Renderer) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 2*borderpx+term.col*r.cw, 2*borderpx+term.row*r.ch))
+	xdraw.Draw(img, img.Bounds(), image.NewUniform(r.pal[defaultbg]), image.Point{}, xdraw.Src)
+	for y := 0; y < term.row; y++ {
+		line := tline(y)
+		for x := 0; x < term.col; x++ {
+			if line[x].mode&ATTR_WDUMMY == 0 {
+				renderglyph(img, r, line[x], x, y)
+			}
+		}
+	}
+	return img
+}
+
+func renderglyph(img *image.RGBA, r *Renderer, g Glyph, x, y int) {
+	fg, bg := glyphcolors(r.pal, g)
+	w := r.cw
+	if g.mode&ATTR_WIDE != 0 {
+		w *= 2
+	}
+	px := borderpx + x*r.cw
+	py := borderpx + y*r.ch
+	cell := image.Rect(px, py, px+w, py+r.ch)
+	xdraw.Draw(img, cell, image.NewUniform(bg), image.Point{}, xdraw.Src)
+
+	// images below the text only show in the blank cells
+	if p := placements[g.img]; g.img != 0 && p != nil && (p.z >= 0 || g.u == ' ') {
+		pix := imgscaled(p, r.cw, r.ch)
+		sp := image.Pt(int(g.imgx)*r.cw, int(g.imgy)*r.ch)
+		xdraw.Draw(img, cell, image.NewUniform(r.pal[defaultbg]), image.Point{}, xdraw.Src)
+		xdraw.Draw(img, cell, pix, sp, xdraw.Over)
+		return
+	}
+
+	face := 0
+	if g.mode&ATTR_BOLD != 0 {
+		face |= 1
+	}
+	if g.mode&ATTR_ITALIC != 0 {
+		face |= 2
+	}
+	if g.u != ' ' && g.u != 0 {
+		d := xfont.Drawer{
+			Dst:  img.SubImage(cell).(*image.RGBA),
+			Src:  image.NewUniform(fg),
+			Face: r.face[face],
+			Dot:  fixed.P(px, py+r.ascent),
+		}
+		d.DrawString(string(g.u))
+	}
+
+	if g.mode&ATTR_UNDERLINE != 0 {
+		xdraw.Draw(img, image.Rect(px, py+r.ascent+1, px+w, py+r.ascent+2),
+			image.NewUniform(fg), image.Point{}, xdraw.Src)
+	}
+	if g.mode&ATTR_STRUCK != 0 {
+		xdraw.Draw(img, image.Rect(px, py+2*r.ascent/3, px+w, py+2*r.ascent/3+1),
+			image.NewUniform(fg), image.Point{}, xdraw.Src)
+	}
+}
+
+// renderpng feeds the input to the terminal and writes the resulting
+// screen to a PNG file, or to the standard output for "-"
+func renderpng(path string, in io.Reader) error {
+	r, err := rendernew(renderfontsize)
+	if err != nil {
+		return err
+	}
+	// the cell size is needed to place images
+	win.cw, win.ch = r.cw, r.ch
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	ttyfeed(data)
+
+	out := os.Stdout
+	if path != "-" {
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	return png.Encode(out, renderscreen(r))
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+// Incremental search of the history and the screen. The pattern is typed
+// in a prompt over the bottom line, all the matches are highlighted as it
+// changes and the view scrolls to the current one.
+
+type SearchMatch struct {
+	x1, i1 int // first cell, i counts from the oldest line in history
+	x2, i2 int // last cell
+}
+
+type Search struct {
+	active   bool
+	pat      []rune
+	backward bool
+	regex    bool
+	icase    bool
+	err      error
+	ox, oi   int // where the search started
+	matches  []SearchMatch
+	cur      int // current match, -1 if none
+}
+
+var search Search
+
+// searchstart opens the prompt, searching down from the top of the view
+// for arg > 0 and up from its bottom for arg < 0
+func searchstart(arg interface{}) {
+	search = Search{
+		active:   true,
+		backward: arg.(int) < 0,
+		regex:    searchregex,
+		icase:    searchignorecase,
+		cur:      -1,
+	}
+	search.oi = term.histn - term.scr
+	if search.backward {
+		search.ox, search.oi = term.col-1, search.oi+term.row-1
+	}
+	searchprompt()
+}
+
+// searchstop closes the prompt and removes the highlights
+func searchstop() {
+	search.active = false
+	search.matches = nil
+	xsetoverlay(nil)
+}
+
+// searchkey handles a key typed in the prompt, return is left to the
+// front end as it selects the current match
+func searchkey(s string) {
+	sr := &search
+	switch s {
+	case "\033":
+		searchstop()
+		return
+	case "\b", "\177":
+		if len(sr.pat) == 0 {
+			return
+		}
+		sr.pat = sr.pat[:len(sr.pat)-1]
+	case "\025": // ctrl-u
+		sr.pat = nil
+	case "\016": // ctrl-n
+		searchstep(+1)
+		return
+	case "\020": // ctrl-p
+		searchstep(-1)
+		return
+	case "\022": // ctrl-r
+		sr.regex = !sr.regex
+	case "\024": // ctrl-t
+		sr.icase = !sr.icase
+	default:
+		for _, u := range s {
+			if u < ' ' || u == 0177 || (0x80 <= u && u < 0xa0) {
+				return
+			}
+		}
+		sr.pat = append(sr.pat, []rune(s)...)
+	}
+
+	searchrun()
+	searchfirst()
+	searchshow()
+	searchprompt()
+}
+
+// searchrun finds all the matches
+func searchrun() {
+	sr := &search
+	sr.matches, sr.cur, sr.err = nil, -1, nil
+	if len(sr.pat) == 0 {
+		return
+	}
+	pat := string(sr.pat)
+	if !sr.regex {
+		pat = regexp.QuoteMeta(pat)
+	}
+	if sr.icase {
+		pat = "(?i)" + pat
+	}
+	re, err := regexp.Compile(pat)
+	if err != nil {
+		sr.err = err
+		return
+	}
+
+	tmatches(re, 0, term.histn+term.row, func(m SearchMatch, _ string) {
+		sr.matches = append(sr.matches, m)
+	})
+}
+
+// tmatches calls f for each match of re in the n lines from line i,
+// counted from the oldest line in history, with the text matched. A
+// match can go on in the lines a line wraps into.
+func tmatches(re *regexp.Regexp, i, n int, f func(m SearchMatch, s string)) {
+	type cell struct{ x, i int }
+	end := i + n
+	for ; i < end; i++ {
+		var b []byte
+		var at []cell // the cell of each byte
+		for ; i < end; i++ {
+			l := thistline(i)
+			for x, g := range l {
+				if g.mode&ATTR_WDUMMY != 0 {
+					continue
+				}
+				u := g.u
+				if u == 0 {
+					u = ' '
+				}
+				for k := utf8.RuneLen(u); k > 0; k-- {
+					at = append(at, cell{x, i})
+				}
+				b = utf8.AppendRune(b, u)
+			}
+			if l[term.col-1].mode&ATTR_WRAP == 0 {
+				break
+			}
+		}
+
+		for _, m := range re.FindAllIndex(b, -1) {
+			if m[0] == m[1] {
+				continue
+			}
+			p, q := at[m[0]], at[m[1]-1]
+			f(SearchMatch{p.x, p.i, q.x, q.i}, string(b[m[0]:m[1]]))
+		}
+	}
+}
+
+// searchfirst makes the first match from where the search started,
+// in its direction, the current one
+func searchfirst() {
+	sr := &search
+	n := len(sr.matches)
+	if n == 0 {
+		return
+	}
+	// index of the first match starting after the origin
+	k := sort.Search(n, func(k int) bool {
+		m := sr.matches[k]
+		return m.i1 > sr.oi || (m.i1 == sr.oi && m.x1 > sr.ox)
+	})
+	if sr.backward {
+		sr.cur = (k - 1 + n) % n
+		return
+	}
+	// the origin is part of a forward search
+	if k > 0 && sr.matches[k-1].i1 == sr.oi && sr.matches[k-1].x1 == sr.ox {
+		k--
+	}
+	sr.cur = k % n
+}
+
+// searchstep moves to the next match in the direction of the search
+// for dir > 0, to the previous one for dir < 0
+func searchstep(dir int) {
+	sr := &search
+	n := len(sr.matches)
+	if n == 0 {
+		return
+	}
+	if sr.backward {
+		dir = -dir
+	}
+	sr.cur = (sr.cur + dir + n) % n
+	searchshow()
+	searchprompt()
+}
+
+// searchshow scrolls the view to the current match
+func searchshow() {
+	sr := &search
+	if sr.cur >= 0 {
+		m := sr.matches[sr.cur]
+		if top := term.histn - term.scr; m.i1 < top {
+			kscrollup(top - m.i1)
+		} else if m.i1 >= top+term.row-1 {
+			// above the prompt
+			kscrolldown(m.i1 - top - term.row + 2)
+		}
+	}
+	tfulldirt()
+}
+
+func searchprompt() {
+	sr := &search
+	c := '/'
+	if sr.backward {
+		c = '?'
+	}
+	s := fmt.Sprintf("%c%s", c, string(sr.pat))
+	if sr.regex {
+		s += "  [regex]"
+	}
+	if sr.icase {
+		s += "  [ignore case]"
+	}
+	switch {
+	case sr.err != nil:
+		s += "  bad pattern"
+	case len(sr.pat) == 0:
+	case sr.cur < 0:
+		s += "  no match"
+	default:
+		s += fmt.Sprintf("  %d/%d", sr.cur+1, len(sr.matches))
+	}
+	xsetoverlay([]Line{tstrline(s, Glyph{fg: defaultfg, bg: defaultbg, mode: ATTR_REVERSE})})
+}
+
+// searchselect makes the current match the selection and closes the
+// prompt, it returns false if there is no match
+func searchselect() bool {
+	sr := &search
+	if sr.cur < 0 {
+		searchstop()
+		return false
+	}
+	m := sr.matches[sr.cur]
+	top := term.histn - term.scr
+	searchstop()
+
+	selclear()
+	sel.typ = SEL_REGULAR
+	sel.alt = term.mode&MODE_ALTSCREEN != 0
+	sel.snap = 0
+	sel.ob.x, sel.ob.y = m.x1, m.i1-top
+	sel.oe.x, sel.oe.y = m.x2, m.i2-top
+	selnormalize()
+	tsetdirt(sel.nb.y, sel.ne.y)
+	return true
+}
+
+// searchattr returns the highlight of the cell at x, y of the view
+func searchattr(x, y int) uint {
+	sr := &search
+	if len(sr.matches) == 0 {
+		return 0
+	}
+	i := term.histn - term.scr + y
+	// the first match not ending before the cell
+	k := sort.Search(len(sr.matches), func(k int) bool {
+		m := sr.matches[k]
+		return m.i2 > i || (m.i2 == i && m.x2 >= x)
+	})
+	if k == len(sr.matches) {
+		return 0
+	}
+	if m := sr.matches[k]; m.i1 > i || (m.i1 == i && m.x1 > x) {
+		return 0
+	}
+	if k == sr.cur {
+		return ATTR_HIGHLIGHT | ATTR_HIGHLIGHT_CUR
+	}
+	return ATTR_HIGHLIGHT
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
-	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,19 +21,29 @@ import (
 )
 
 const (
-	ATTR_NULL       = 0
-	ATTR_BOLD       = 1 << 0
-	ATTR_FAINT      = 1 << 1
-	ATTR_ITALIC     = 1 << 2
-	ATTR_UNDERLINE  = 1 << 3
-	ATTR_BLINK      = 1 << 4
-	ATTR_REVERSE    = 1 << 5
-	ATTR_INVISIBLE  = 1 << 6
-	ATTR_STRUCK     = 1 << 7
-	ATTR_WRAP       = 1 << 8
-	ATTR_WIDE       = 1 << 9
-	ATTR_WDUMMY     = 1 << 10
-	ATTR_BOLD_FAINT = ATTR_BOLD | ATTR_FAINT
+	ATTR_NULL          = 0
+	ATTR_BOLD          = 1 << 0
+	ATTR_FAINT         = 1 << 1
+	ATTR_ITALIC        = 1 << 2
+	ATTR_UNDERLINE     = 1 << 3
+	ATTR_BLINK         = 1 << 4
+	ATTR_REVERSE       = 1 << 5
+	ATTR_INVISIBLE     = 1 << 6
+	ATTR_STRUCK        = 1 << 7
+	ATTR_WRAP          = 1 << 8
+	ATTR_WIDE          = 1 << 9
+	ATTR_WDUMMY        = 1 << 10
+	ATTR_HIGHLIGHT     = 1 << 11 // search matches, only set when drawing
+	ATTR_HIGHLIGHT_CUR = 1 << 12
+	ATTR_BOLD_FAINT    = ATTR_BOLD | ATTR_FAINT
+)
+
+// Semantic zones of a cell as reported by OSC 133
+const (
+	ZONE_NONE   = 0
+	ZONE_PROMPT = 1
+	ZONE_INPUT  = 2
+	ZONE_OUTPUT = 3
 )
 
 const (
@@ -48,6 +60,14 @@ const (
 const (
 	SNAP_WORD = 1
 	SNAP_LINE = 2
+	SNAP_PAIR = 3 // the inside of brackets or quotes, else the line
+)
+
+// Treatment of the control characters in pastes
+const (
+	PASTE_KEEP  = 0
+	PASTE_STRIP = 1
+	PASTE_CARET = 2 // shown as ^X
 )
 
 const (
@@ -82,29 +102,24 @@ const (
 	CS_FIN
 )
 
-const (
-	ESC_START      = 1
-	ESC_CSI        = 2
-	ESC_STR        = 4 // OSC, PM, APC
-	ESC_ALTCHARSET = 8
-	ESC_STR_END    = 16 // a final string was encountered
-	ESC_TEST       = 32 // Enter in test mode
-	ESC_UTF8       = 64
-	ESC_DCS        = 128
-)
-
 const (
 	ESC_BUF_SIZ = 128 * utf8.UTFMax
-	ESC_ARG_SIZ = 16
+	ESC_ARG_SIZ = 256
+	ESC_SUB_SIZ = 16
+	ESC_ARG_MAX = 65535 // larger values are clamped
 	STR_BUF_SIZ = ESC_BUF_SIZ
-	STR_ARG_SIZ = ESC_ARG_SIZ
+	STR_ARG_SIZ = 16
 )
 
 type Glyph struct {
 	u    rune
+	zone uint8 // semantic zone (prompt, input, output)
 	mode uint
 	fg   uint32
 	bg   uint32
+	img  uint32 // image placement shown in the cell, 0 if none
+	imgx uint16 // column of the cell in the placement
+	imgy uint16 // row of the cell in the placement
 }
 
 type Line []Glyph
@@ -127,52 +142,61 @@ type Selection struct {
 	// oe – original coordinates of the end of the selection
 	nb, ne, ob, oe struct{ x, y int }
 
-	alt bool
+	alt   bool
+	level int // pair around the word for SNAP_PAIR, from 1
 }
 
 // Internal representation of the screen
 type Term struct {
-	row      int     // nb row
-	col      int     // nb col
-	line     []Line  // screen
-	alt      []Line  // alternate screen
-	dirty    []bool  // dirtyness of lines
-	c        TCursor // cursor
-	ocx      int     // old cursor col
-	ocy      int     // old cursor row
-	top      int     // top scroll limit
-	bot      int     // bottom scroll limit
-	mode     int     // terminal mode flags
-	esc      int     // escape state flags
-	trantbl  [4]byte // charset table translation
-	charset  int     // current charset
-	icharset int     // selected charset for sequence
+	row      int      // nb row
+	col      int      // nb col
+	line     []Line   // screen
+	alt      []Line   // alternate screen
+	dirty    []bool   // dirtyness of lines
+	c        TCursor  // cursor
+	ocx      int      // old cursor col
+	ocy      int      // old cursor row
+	top      int      // top scroll limit
+	bot      int      // bottom scroll limit
+	mode     int      // terminal mode flags
+	vt       VTParser // escape sequence parser
+	trantbl  [4]byte  // charset table translation
+	charset  int      // current charset
+	icharset int      // selected charset for sequence
 	tabs     []bool
 	tc       [2]TCursor
+	hist     []Line // history buffer
+	histi    int    // history index
+	histn    int    // nb of lines in history
+	scr      int    // scroll back
+	status   int    // exit status of the last command (OSC 133), -1 if unknown
+	cwd      string // working directory reported by OSC 7
 	buf      [32768]byte
 	buflen   int
 	rdy      chan struct{}
 }
 
 // CSI Escape sequence structs
-// ESC '[' [[ [<priv>] <arg> [;]] <mode> [<mode>]]
+// ESC '[' [<priv>] [<arg> [:<sub>] [;]] [<inter>] <mode>
 type CSIEscape struct {
-	buf  [ESC_BUF_SIZ]byte // raw string
-	len  int               // raw string length
-	priv bool
-	arg  [ESC_ARG_SIZ]int // arguments
-	narg int              // nb of args
-	mode [2]int
+	buf   []byte  // raw string
+	priv  byte    // private marker: '?', '>', '<' or '='
+	arg   []int   // arguments
+	sub   [][]int // sub-parameters of each argument
+	narg  int     // nb of args
+	cur   *int    // parameter being read, nil past the limits
+	inter []byte  // intermediate characters
+	mode  int     // final character
 }
 
 // STR Escape sequence structs
 // ESC type [[ [<priv>] <arg> [;]] <mode>] ESC '\'
 type STREscape struct {
-	typ  int                 // ESC type
-	buf  [STR_BUF_SIZ]byte   // raw string
-	len  int                 // raw string length
-	args [STR_ARG_SIZ][]byte // arguments
-	narg int
+	typ      int                 // ESC type
+	buf      []byte              // raw string
+	args     [STR_ARG_SIZ][]byte // arguments
+	narg     int
+	overflow bool // the string was too long and is being skipped
 }
 
 var (
@@ -183,6 +207,7 @@ var (
 	cmdfile   *os.File
 	iofile    *os.File
 	pid       int
+	snapres   []*regexp.Regexp // snappatterns, compiled on first use
 )
 
 func truecolor(r, g, b int) int32 {
@@ -228,14 +253,37 @@ func selinit() {
 	sel.ob.x = -1
 }
 
+// tline returns the line at row y of the view, taking scroll back into account
+func tline(y int) Line {
+	if y < term.scr {
+		return term.hist[(y+term.histi-term.scr+histsize+1)%histsize]
+	}
+	return term.line[y-term.scr]
+}
+
+// thistline returns the line at index i of the history followed by the
+// screen, where 0 is the oldest line kept in history
+func thistline(i int) Line {
+	if i < term.histn {
+		return term.hist[(term.histi-term.histn+1+i+histsize)%histsize]
+	}
+	return term.line[i-term.histn]
+}
+
 func tlinelen(y int) int {
-	i := term.col
+	return linelen(tline(y))
+}
 
-	if term.line[y][i-1].mode&ATTR_WRAP != 0 {
+// linelen returns the length of a line without the trailing blanks,
+// unless it wraps
+func linelen(l Line) int {
+	i := len(l)
+
+	if l[i-1].mode&ATTR_WRAP != 0 {
 		return i
 	}
 
-	for i > 0 && term.line[y][i-1].u == ' ' {
+	for i > 0 && l[i-1].u == ' ' {
 		i--
 	}
 
@@ -326,14 +374,20 @@ func ttyresize(tw, th int) {
 		Xpixel: uint16(tw),
 		Ypixel: uint16(th),
 	}
+	if cmdfile == nil {
+		return
+	}
 	cmdfd := int(cmdfile.Fd())
 	err := unix.IoctlSetWinsize(cmdfd, unix.TIOCSWINSZ, &w)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Couldn't set window size: %v", err)
+		fmt.Fprintf(os.Stderr, "Couldn't set window size: %v\n", err)
 	}
 }
 
 func ttyhangup() {
+	if cmdfile == nil {
+		return
+	}
 	// Send SIGHUP to shell
 	proc, err := os.FindProcess(pid)
 	if err != nil {
@@ -409,6 +463,8 @@ func treset() {
 	}
 	term.top = 0
 	term.bot = term.row - 1
+	term.scr = 0
+	term.status = -1
 	term.mode = MODE_WRAP | MODE_UTF8
 	for i := range term.trantbl {
 		term.trantbl[i] = CS_USA
@@ -437,10 +493,20 @@ func tnew(col, row int) {
 }
 
 func ttywrite(s []byte, may_echo bool) {
+	// user input always brings the view back to the screen
+	if may_echo && term.scr > 0 {
+		kscrolldown(term.scr)
+	}
+
 	if may_echo && term.mode&MODE_ECHO != 0 {
 		twrite(s, true)
 	}
 
+	// the replies of the terminal are not user input
+	if may_echo {
+		recinput(s)
+	}
+
 	if term.mode&MODE_CRLF == 0 {
 		ttywriteraw(s)
 		return
@@ -465,11 +531,88 @@ func ttywrite(s []byte, may_echo bool) {
 	}
 }
 
+// tfilterpaste applies the pastefilter setting to a paste whose line
+// endings are already '\r', and makes sure it cannot end a bracketed
+// paste early
+func tfilterpaste(s []byte, brckt bool) []byte {
+	b := make([]byte, 0, len(s))
+	for len(s) > 0 {
+		u, n := utf8.DecodeRune(s)
+		if u == utf8.RuneError && n == 1 && iscontrolc1(rune(s[0])) {
+			// an 8-bit C1 control, as a terminal out of utf8 reads it
+			u = rune(s[0])
+		}
+		if u == utf8.RuneError && n <= 1 || !iscontrol(u) || u == '\t' || u == '\r' {
+			b = append(b, s[:n]...)
+			s = s[n:]
+			continue
+		}
+		c := s[:n]
+		s = s[n:]
+
+		switch pastefilter {
+		case PASTE_KEEP:
+			b = append(b, c...)
+		case PASTE_CARET:
+			if iscontrolc1(u) {
+				// as the 7-bit ESC sequence
+				b = append(b, '^', '[', byte(u-0x40))
+			} else {
+				b = append(b, '^', byte(u^0x40))
+			}
+		}
+	}
+
+	// until none is left, removing one may join the parts of another
+	for brckt && pastefilter == PASTE_KEEP {
+		n := len(b)
+		b = bytes.ReplaceAll(b, []byte("\033[201~"), nil)
+		b = bytes.ReplaceAll(b, []byte("\u009b201~"), nil)
+		if len(b) == n {
+			break
+		}
+	}
+	return b
+}
+
+// tstrline returns a line of the terminal width showing s with the
+// attributes of g, for the overlays drawn over the screen
+func tstrline(s string, g Glyph) Line {
+	line := make(Line, term.col)
+	for i := range line {
+		line[i] = g
+		line[i].u = ' '
+	}
+	x := 0
+	for _, u := range s {
+		w := posix.Wcwidth(u)
+		if w < 0 {
+			u, w = '?', 1
+		}
+		if w == 0 {
+			continue
+		}
+		if x+w > term.col {
+			break
+		}
+		line[x].u = u
+		if w == 2 {
+			line[x].mode |= ATTR_WIDE
+			line[x+1].mode |= ATTR_WDUMMY
+		}
+		x += w
+	}
+	return line
+}
+
 func ttywriteraw(s []byte) {
 	// Remember that we are using a pty, which might be a modem line.
 	// Writing too much will clog the line. That's why we are doing this
 	// dance.
 	// FIXME: Migrate the world to Plan 9.
+	if cmdfile == nil {
+		return // replaying, there is no one to write to
+	}
 	lim := 256
 	for len(s) > 0 {
 		n := min(len(s), lim)
@@ -502,27 +645,87 @@ func tscrolldown(orig, n int) {
 		term.line[i], term.line[i-n] = term.line[i-n], term.line[i]
 	}
 
-	selscroll(orig, n)
+	selscroll(orig, n, false, term.scr)
 }
 
-func tscrollup(orig, n int) {
+func tscrollup(orig, n int, copyhist bool) {
 	n = clamp(n, 0, term.bot-orig+1)
+	scr := term.scr
+
+	hist := copyhist && orig == 0 && histsize > 0 && term.mode&MODE_ALTSCREEN == 0
+	if hist {
+		for i := 0; i < n; i++ {
+			term.histi = (term.histi + 1) % histsize
+			term.hist[term.histi], term.line[orig+i] = term.line[orig+i], term.hist[term.histi]
+		}
+		term.histn = min(term.histn+n, histsize)
+		if term.scr > 0 {
+			term.scr = min(term.scr+n, term.histn)
+		}
+	}
 
-	tclearregion(0, orig, term.col-1, orig+n-1)
-	tsetdirt(orig+n, term.bot)
+	if !keepselection {
+		tclearregion(0, orig, term.col-1, orig+n-1)
+	}
+	tsetdirt(orig, term.bot)
 
 	for i := orig; i <= term.bot-n; i++ {
 		term.line[i], term.line[i+n] = term.line[i+n], term.line[i]
 	}
-	selscroll(orig, -n)
+	selscroll(orig, -n, hist, scr)
+
+	// the lines scrolled out, at the bottom now, once the selection
+	// went up with the others
+	if keepselection {
+		tclearregion(0, term.bot-n+1, term.col-1, term.bot)
+	}
 }
 
-func selscroll(orig, n int) {
+// selscroll moves the selection with the lines scrolled by n from orig
+// to term.bot, down for n > 0. hist tells the lines scrolled up went to
+// the history, scr is the scroll back before the scroll.
+func selscroll(orig, n int, hist bool, scr int) {
 	if sel.ob.x == -1 {
 		return
 	}
+	if !keepselection {
+		selscrollclear(orig, n)
+		return
+	}
+	if sel.alt != (term.mode&MODE_ALTSCREEN != 0) {
+		return
+	}
+
+	// the lines that moved, in screen rows before the scroll
+	moved := func(y int) bool {
+		return y <= term.bot && (y >= orig || hist)
+	}
+	b, e := sel.nb.y-scr, sel.ne.y-scr
+	d := term.scr - scr
+	switch {
+	case moved(b) && moved(e):
+		if !hist && (b+n < orig || e+n > term.bot) {
+			// scrolled out of the region
+			selclear()
+			return
+		}
+		d += n
+	case moved(b) || moved(e):
+		selclear()
+		return
+	}
+	selmove(d)
 
-	if (sel.ob.y <= orig && orig <= term.bot) || (sel.oe.y <= orig && orig <= term.bot) {
+	// out of the history
+	if sel.nb.y < term.scr-term.histn {
+		selclear()
+	}
+}
+
+// selscrollclear is selscroll when the selection is not kept, it is
+// clamped to the region or cleared when it leaves it
+func selscrollclear(orig, n int) {
+	if orig <= sel.ob.y && sel.ob.y <= term.bot || orig <= sel.oe.y && sel.oe.y <= term.bot {
 		sel.ob.y += n
 		sel.oe.y += n
 		if sel.ob.y > term.bot || sel.oe.y < term.top {
@@ -550,10 +753,121 @@ func selscroll(orig, n int) {
 	}
 }
 
+// selmove moves the selection n rows down the view
+func selmove(n int) {
+	sel.ob.y += n
+	sel.oe.y += n
+	sel.nb.y += n
+	sel.ne.y += n
+}
+
+func kscrolldown(arg interface{}) {
+	n := arg.(int)
+	if n < 0 {
+		n = term.row + n
+	}
+	n = min(n, term.scr)
+
+	if n > 0 {
+		term.scr -= n
+		selkscroll(-n)
+		tfulldirt()
+	}
+}
+
+func kscrollup(arg interface{}) {
+	n := arg.(int)
+	if n < 0 {
+		n = term.row + n
+	}
+	n = min(n, term.histn-term.scr)
+
+	if n > 0 {
+		term.scr += n
+		selkscroll(n)
+		tfulldirt()
+	}
+}
+
+// selkscroll moves the selection with the view scrolled by n through
+// the history
+func selkscroll(n int) {
+	switch {
+	case sel.ob.x == -1:
+	case !keepselection:
+		selscrollclear(0, n)
+	case sel.alt == (term.mode&MODE_ALTSCREEN != 0):
+		selmove(n)
+	}
+}
+
+// tisprompt reports whether line l starts a prompt
+func tisprompt(l Line) bool {
+	return len(l) > 0 && l[0].zone == ZONE_PROMPT
+}
+
+// kscrollprompt scrolls the view so the previous (arg < 0) or the next
+// (arg > 0) prompt in the history is at the top
+func kscrollprompt(arg interface{}) {
+	dir := arg.(int)
+	for i := term.histn - term.scr + dir; 0 <= i && i <= term.histn; i += dir {
+		if tisprompt(thistline(i)) && (i == 0 || !tisprompt(thistline(i-1))) {
+			if n := term.histn - i - term.scr; n > 0 {
+				kscrollup(n)
+			} else {
+				kscrolldown(-n)
+			}
+			return
+		}
+	}
+
+	// no more prompts in the history, the next one is on the screen
+	if dir > 0 {
+		kscrolldown(term.scr)
+	}
+}
+
+// tselcmdoutput selects the output of the last command visible in the view,
+// returns false if there is none
+func tselcmdoutput() bool {
+	hastype := func(y int, zone uint8) bool {
+		for _, g := range tline(y) {
+			if g.zone == zone {
+				return true
+			}
+		}
+		return false
+	}
+
+	end := term.row - 1
+	for ; end >= 0 && !hastype(end, ZONE_OUTPUT); end-- {
+	}
+	if end < 0 {
+		return false
+	}
+
+	begin := end
+	for ; begin > 0; begin-- {
+		if hastype(begin-1, ZONE_PROMPT) || hastype(begin-1, ZONE_INPUT) {
+			break
+		}
+	}
+
+	selclear()
+	sel.typ = SEL_REGULAR
+	sel.alt = term.mode&MODE_ALTSCREEN != 0
+	sel.snap = 0
+	sel.ob.x, sel.ob.y = 0, begin
+	sel.oe.x, sel.oe.y = term.col-1, end
+	selnormalize()
+	tsetdirt(sel.nb.y, sel.ne.y)
+	return true
+}
+
 func tnewline(first_col bool) {
 	y := term.c.y
 	if y == term.bot {
-		tscrollup(term.top, 1)
+		tscrollup(term.top, 1, true)
 	} else {
 		y++
 	}
@@ -565,42 +879,58 @@ func tnewline(first_col bool) {
 	tmoveto(x, y)
 }
 
-func csiparse() {
-	csiescseq.narg = 0
-	p := csiescseq.buf[:csiescseq.len]
-	if len(p) > 0 && p[0] == '?' {
-		csiescseq.priv = true
-		p = p[1:]
+func csiparam(u rune) {
+	if csiescseq.narg == 0 {
+		csinewarg()
 	}
 
-	for len(p) > 0 {
-		v, np, _ := posix.Strtol(string(p), 10)
-		if np == 0 {
-			v = 0
+	switch u {
+	case ';':
+		if csiescseq.narg < ESC_ARG_SIZ {
+			csinewarg()
+		} else {
+			csiescseq.cur = nil
 		}
-		if v == math.MaxInt64 || v == math.MinInt64 {
-			v = -1
+	case ':':
+		i := csiescseq.narg - 1
+		if csiescseq.cur != nil && len(csiescseq.sub[i]) < ESC_SUB_SIZ {
+			csiescseq.sub[i] = append(csiescseq.sub[i], 0)
+			csiescseq.cur = &csiescseq.sub[i][len(csiescseq.sub[i])-1]
+		} else {
+			csiescseq.cur = nil
 		}
+	default:
+		if p := csiescseq.cur; p != nil {
+			*p = min(*p*10+int(u-'0'), ESC_ARG_MAX)
+		}
+	}
+}
 
-		csiescseq.arg[csiescseq.narg] = int(v)
-		csiescseq.narg++
+func csinewarg() {
+	csiescseq.arg = append(csiescseq.arg, 0)
+	csiescseq.sub = append(csiescseq.sub, nil)
+	csiescseq.narg++
+	csiescseq.cur = &csiescseq.arg[csiescseq.narg-1]
+}
 
-		p = p[np:]
-		if len(p) > 0 {
-			if p[0] != ';' || csiescseq.narg == ESC_ARG_SIZ {
-				break
-			}
-			p = p[1:]
-		}
+func csicollect(u rune) {
+	if 0x3c <= u && u <= 0x3f {
+		csiescseq.priv = byte(u)
+	} else if len(csiescseq.inter) < VT_INTER_MAX {
+		csiescseq.inter = append(csiescseq.inter, byte(u))
 	}
+}
 
-	for i := 0; i < 2; i++ {
-		csiescseq.mode[i] = 0
-		if i < len(p) {
-			csiescseq.mode[i] = int(p[i])
-			p = p[1:]
-		}
+func csidispatch(u rune) {
+	if csiescseq.narg == 0 {
+		csinewarg()
 	}
+	// the handlers read the first two arguments without checking
+	for len(csiescseq.arg) < 2 {
+		csiescseq.arg = append(csiescseq.arg, 0)
+	}
+	csiescseq.mode = int(u)
+	csihandle()
 }
 
 // for absolute user moves, when decom is set
@@ -676,12 +1006,14 @@ func tclearregion(x1, y1, x2, y2 int) {
 		term.dirty[y] = true
 		for x := x1; x <= x2; x++ {
 			gp := &term.line[y][x]
-			if selected(x, y) {
+			if selected(x, y+term.scr) {
 				selclear()
 			}
 			gp.fg = term.c.attr.fg
 			gp.bg = term.c.attr.bg
 			gp.mode = 0
+			gp.zone = ZONE_NONE
+			gp.img = 0
 			gp.u = ' '
 		}
 	}
@@ -719,12 +1051,16 @@ func tinsertblankline(n int) {
 
 func tdeleteline(n int) {
 	if term.top <= term.c.y && term.c.y <= term.bot {
-		tscrollup(term.c.y, n)
+		tscrollup(term.c.y, n, false)
 	}
 }
 
 func tdefcolor(attr []int, npar *int) int32 {
 	idx := int32(-1)
+	if *npar+1 >= len(attr) {
+		fmt.Fprintf(os.Stderr, "erresc(38): Incorrect number of parameters (%d)\n", *npar)
+		return idx
+	}
 	switch attr[*npar+1] {
 	case 2: // direct color in RGB space
 		if *npar+4 >= len(attr) {
@@ -736,7 +1072,7 @@ func tdefcolor(attr []int, npar *int) int32 {
 		b := attr[*npar+4]
 		*npar += 4
 		if !(0 <= r && r <= 255) || !(0 <= g && g <= 255) || !(0 <= b && b <= 255) {
-			fmt.Fprintf(os.Stderr, "erresc: bad rgb color (%u,%u,%u)\n", r, g, b)
+			fmt.Fprintf(os.Stderr, "erresc: bad rgb color (%d,%d,%d)\n", r, g, b)
 		} else {
 			idx = truecolor(r, g, b)
 		}
@@ -765,8 +1101,42 @@ func tdefcolor(attr []int, npar *int) int32 {
 	return idx
 }
 
-func tsetattr(attr []int) {
+// tsubcolor reads a color given with sub-parameters, 38:5:n or
+// 38:2:[colorspace]:r:g:b, in the same way as tdefcolor
+func tsubcolor(attr int, sub []int) int32 {
+	if len(sub) >= 5 && sub[0] == 2 {
+		// skip the colorspace id
+		sub = append([]int{2}, sub[2:5]...)
+	}
+	i := 0
+	return tdefcolor(append([]int{attr}, sub...), &i)
+}
+
+func tsetattr(attr []int, sub [][]int) {
 	for i := 0; i < len(attr); i++ {
+		if len(sub[i]) > 0 {
+			switch attr[i] {
+			case 4:
+				if sub[i][0] == 0 {
+					term.c.attr.mode &^= ATTR_UNDERLINE
+				} else {
+					// all the underline styles look the same
+					term.c.attr.mode |= ATTR_UNDERLINE
+				}
+			case 38:
+				if idx := tsubcolor(attr[i], sub[i]); idx >= 0 {
+					term.c.attr.fg = uint32(idx)
+				}
+			case 48:
+				if idx := tsubcolor(attr[i], sub[i]); idx >= 0 {
+					term.c.attr.bg = uint32(idx)
+				}
+			default:
+				fmt.Fprintf(os.Stderr, "erresc: gfx attr %d with sub-parameters unknown\n", attr[i])
+			}
+			continue
+		}
+
 		switch attr[i] {
 		case 0:
 			term.c.attr.mode &^= (ATTR_BOLD |
@@ -856,10 +1226,25 @@ func tresize(col, row int) {
 
 	// ensure that both src and dst are not NULL
 	var line, alt []Line
-	i := term.c.y - row
+	i := term.c.y - row + 1
 	if i > 0 {
 		copy(term.line[:row], term.line[i:])
 		copy(term.alt[:row], term.alt[i:])
+
+		// the selection goes up with its lines, or with the lines
+		// freed when on them
+		if sel.ob.x != -1 && sel.ne.y >= term.scr {
+			if sel.nb.y-term.scr >= i {
+				selmove(-i)
+			} else {
+				selclear()
+			}
+		}
+	}
+
+	// the selection would point out of the screen
+	if max(max(sel.ob.x, sel.oe.x), sel.ne.x) >= col || max(sel.ob.y, sel.oe.y) >= row+term.scr {
+		selclear()
 	}
 
 	// resize to new height
@@ -882,12 +1267,26 @@ func tresize(col, row int) {
 		copy(term.alt[i], alt)
 	}
 
+	// resize the history to the new width
+	if len(term.hist) != histsize {
+		term.hist = make([]Line, histsize)
+	}
+	for i := range term.hist {
+		hist := term.hist[i]
+		term.hist[i] = make([]Glyph, col)
+		copy(term.hist[i], hist)
+		for j := len(hist); j < col; j++ {
+			term.hist[i][j] = term.c.attr
+			term.hist[i][j].u = ' '
+		}
+	}
+
 	if col > term.col {
 		bp := term.col
 		for i := 0; i < col-term.col; i++ {
 			term.tabs[bp+i] = false
 		}
-		for bp--; bp > len(term.tabs) && !term.tabs[bp]; {
+		for bp--; bp > 0 && !term.tabs[bp]; {
 			bp--
 		}
 		for bp += tabspaces; bp < col; bp += tabspaces {
@@ -1060,7 +1459,15 @@ func csihandle() {
 		csidump()
 	}
 
-	switch csiescseq.mode[0] {
+	// private markers other than '?' and intermediates select
+	// functions st doesn't know about, but for DECSCUSR
+	if (csiescseq.priv != 0 && csiescseq.priv != '?') ||
+		(len(csiescseq.inter) > 0 && csiescseq.mode != 'q') {
+		unknown()
+		return
+	}
+
+	switch csiescseq.mode {
 	default:
 		unknown()
 	case '@': // ICH -- Insert <n> blank char
@@ -1160,7 +1567,7 @@ func csihandle() {
 				tclearregion(0, term.c.y+1, term.col-1, term.row-1)
 			}
 		case 1: // above
-			if term.c.y > 1 {
+			if term.c.y > 0 {
 				tclearregion(0, 0, term.col-1, term.c.y-1)
 			}
 			tclearregion(0, term.c.y, term.c.x, term.c.y)
@@ -1182,7 +1589,7 @@ func csihandle() {
 		if csiescseq.arg[0] == 0 {
 			csiescseq.arg[0] = 1
 		}
-		tscrollup(term.top, csiescseq.arg[0])
+		tscrollup(term.top, csiescseq.arg[0], false)
 	case 'T': // SD -- Scroll <n> line down
 		if csiescseq.arg[0] == 0 {
 			csiescseq.arg[0] = 1
@@ -1194,7 +1601,7 @@ func csihandle() {
 		}
 		tinsertblankline(csiescseq.arg[0])
 	case 'l': // RM -- Reset Mode
-		tsetmode(csiescseq.priv, false, csiescseq.arg[:csiescseq.narg])
+		tsetmode(csiescseq.priv == '?', false, csiescseq.arg[:csiescseq.narg])
 	case 'M': // DL -- Delete <n> lines TODO
 		if csiescseq.arg[0] == 0 {
 			csiescseq.arg[0] = 1
@@ -1221,16 +1628,16 @@ func csihandle() {
 		}
 		tmoveato(term.c.x, csiescseq.arg[0]-1)
 	case 'h': // SM -- Set terminal mode
-		tsetmode(csiescseq.priv, true, csiescseq.arg[:csiescseq.narg])
+		tsetmode(csiescseq.priv == '?', true, csiescseq.arg[:csiescseq.narg])
 	case 'm': // SGR -- Terminal attribute (color)
-		tsetattr(csiescseq.arg[:csiescseq.narg])
+		tsetattr(csiescseq.arg[:csiescseq.narg], csiescseq.sub[:csiescseq.narg])
 	case 'n': // DSR – Device Status Report (cursor position)
 		if csiescseq.arg[0] == 6 {
 			buf := fmt.Sprintf("\033[%d;%dR", term.c.y+1, term.c.x+1)
 			ttywrite([]byte(buf), false)
 		}
 	case 'r': // DECSTBM -- Set Scrolling Region
-		if csiescseq.priv {
+		if csiescseq.priv != 0 {
 			unknown()
 		} else {
 			if csiescseq.arg[0] == 0 {
@@ -1246,13 +1653,8 @@ func csihandle() {
 		tcursor(CURSOR_SAVE)
 	case 'u': // DECRC -- Restore cursor position (ANSI.SYS)
 		tcursor(CURSOR_LOAD)
-	case ' ':
-		switch csiescseq.mode[1] {
-		case 'q': // DECSCUSR -- Set Cursor Style
-			if xsetcursor(csiescseq.arg[0]) {
-				unknown()
-			}
-		default:
+	case 'q': // DECSCUSR -- Set Cursor Style
+		if string(csiescseq.inter) != " " || xsetcursor(csiescseq.arg[0]) {
 			unknown()
 		}
 	}
@@ -1260,8 +1662,7 @@ func csihandle() {
 
 func csidump() {
 	fmt.Fprintf(os.Stderr, "ESC[")
-	for i := 0; i < csiescseq.len; i++ {
-		c := csiescseq.buf[i] & 0xff
+	for _, c := range csiescseq.buf {
 		switch {
 		case unicode.IsPrint(rune(c)):
 			fmt.Fprintf(os.Stderr, "%c", c)
@@ -1279,11 +1680,18 @@ func csidump() {
 }
 
 func csireset() {
-	csiescseq = CSIEscape{}
+	csiescseq = CSIEscape{
+		buf:   csiescseq.buf[:0],
+		arg:   csiescseq.arg[:0],
+		sub:   csiescseq.sub[:0],
+		inter: csiescseq.inter[:0],
+	}
 }
 
 func strhandle() {
-	term.esc &^= (ESC_STR_END | ESC_STR)
+	if strescseq.overflow {
+		return
+	}
 	strparse()
 	par := 0
 	narg := strescseq.narg
@@ -1300,15 +1708,44 @@ func strhandle() {
 				xsettitle(strescseq.args[1])
 			}
 			return
+		case 7:
+			if narg > 1 {
+				tsetcwd(strescseq.args[1])
+			}
+			return
+		case 9:
+			if narg > 1 {
+				tnotify(nil, bytes.Join(strescseq.args[1:narg], []byte(";")))
+			}
+			return
+		case 777:
+			if narg > 2 && string(strescseq.args[1]) == "notify" {
+				var body []byte
+				if narg > 3 {
+					body = bytes.Join(strescseq.args[3:narg], []byte(";"))
+				}
+				tnotify(strescseq.args[2], body)
+				return
+			}
+		case 99:
+			if narg > 2 {
+				notifykitty(strescseq.args[1], bytes.Join(strescseq.args[2:narg], []byte(";")))
+			}
+			return
+		case 1337:
+			if narg > 1 {
+				// the keys are separated by ; too
+				tinlineimage(bytes.Join(strescseq.args[1:narg], []byte(";")))
+			}
+			return
+		case 133:
+			if narg > 1 {
+				tsetzone(strescseq.args[1:narg])
+			}
+			return
 		case 52:
 			if narg > 2 {
-				dec, err := base64.StdEncoding.DecodeString(string(strescseq.args[2]))
-				if err == nil {
-					xsetsel(dec)
-					xclipcopy()
-				} else {
-					fmt.Fprintln(os.Stderr, "erresc: invalid base64")
-				}
+				tclipboard(strescseq.args[1], strescseq.args[2])
 			}
 			return
 		case 4: /* color set */
@@ -1339,27 +1776,135 @@ func strhandle() {
 		xsettitle(strescseq.args[0])
 		return
 	case 'P': // DCS -- Device Control String
-		term.mode |= ESC_DCS
-		fallthrough
+		return
 	case '_': // APC -- Application Program Command
-		fallthrough
+		if len(strescseq.buf) > 0 && strescseq.buf[0] == 'G' {
+			kittygraphics(strescseq.buf[1:])
+		}
+		return
 	case '^': // PM -- Privacy Message
 		return
+	case 'X': // SOS -- Start of String
+		return
 	}
 
 	fmt.Fprintf(os.Stderr, "erresc: unknown str ")
 	strdump()
 }
 
+// tclipboard handles the OSC 52 manipulation of the selection data: the
+// targets pc are c (clipboard), p (primary), s (select) and 0-7 (cut buffers),
+// and the data pd is either base64 or ? to query the selection
+func tclipboard(pc, pd []byte) {
+	if len(pc) == 0 {
+		pc = []byte("s0")
+	}
+
+	clipboard, primary := false, false
+	for _, c := range pc {
+		switch {
+		case c == 'c':
+			clipboard = true
+		case c == 'p' || c == 's' || ('0' <= c && c <= '7'):
+			// there are no cut buffers, use the primary selection
+			primary = true
+		}
+	}
+	if !clipboard && !primary {
+		fmt.Fprintf(os.Stderr, "erresc: unknown selection target %q\n", pc)
+		return
+	}
+
+	if string(pd) == "?" {
+		if !allowosc52read {
+			fmt.Fprintln(os.Stderr, "erresc: reading the selection is disabled")
+			return
+		}
+
+		target, data := "p", xgetsel(false)
+		if clipboard {
+			target, data = "c", xgetsel(true)
+		}
+		if base64.StdEncoding.EncodedLen(len(data)) > osc52maxlen {
+			fmt.Fprintln(os.Stderr, "erresc: selection too large to report")
+			data = nil
+		}
+		buf := fmt.Sprintf("\033]52;%s;%s\033\\", target, base64.StdEncoding.EncodeToString(data))
+		ttywrite([]byte(buf), false)
+		return
+	}
+
+	if len(pd) > osc52maxlen {
+		fmt.Fprintln(os.Stderr, "erresc: selection data too large")
+		return
+	}
+	dec, err := base64.StdEncoding.DecodeString(string(pd))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erresc: invalid base64")
+		return
+	}
+	if primary {
+		xsetsel(dec)
+	}
+	if clipboard {
+		xsetclipboard(dec)
+	}
+}
+
+// tsetcwd handles the working directory notification file://host/path
+func tsetcwd(p []byte) {
+	u, err := url.Parse(string(p))
+	if err != nil || u.Scheme != "file" || u.Path == "" {
+		fmt.Fprintf(os.Stderr, "erresc: invalid working directory %q\n", p)
+		return
+	}
+
+	if host, _ := os.Hostname(); u.Host != "" && u.Host != "localhost" && u.Host != host {
+		// a directory on a remote host is of no use to us
+		term.cwd = ""
+		return
+	}
+	term.cwd = u.Path
+}
+
+// tsetzone handles the FinalTerm semantic prompt marks:
+// A prompt start, B command start, C command executed, D[;status] command finished
+func tsetzone(args [][]byte) {
+	if len(args[0]) == 0 {
+		return
+	}
+
+	switch args[0][0] {
+	case 'A':
+		term.c.attr.zone = ZONE_PROMPT
+	case 'B':
+		term.c.attr.zone = ZONE_INPUT
+	case 'C':
+		term.c.attr.zone = ZONE_OUTPUT
+	case 'D':
+		term.c.attr.zone = ZONE_NONE
+		term.status = -1
+		if len(args) > 1 {
+			if v, err := strconv.Atoi(string(args[1])); err == nil {
+				term.status = v
+			}
+		}
+		xsetstatus(term.status)
+	default:
+		fmt.Fprintf(os.Stderr, "erresc: unknown semantic prompt mark %q\n", args[0])
+	}
+}
+
 func strparse() {
 	strescseq.narg = 0
 
-	p := strescseq.buf[:strescseq.len]
+	p := strescseq.buf
 	if len(p) == 0 {
 		return
 	}
 
-	toks := strings.Split(string(p), ";")
+	// the last argument holds the rest of the string
+	toks := strings.SplitN(string(p), ";", STR_ARG_SIZ)
 	for _, t := range toks {
 		if strescseq.narg < STR_ARG_SIZ {
 			strescseq.args[strescseq.narg] = []byte(t)
@@ -1372,7 +1917,7 @@ func strparse() {
 
 func strdump() {
 	fmt.Fprintf(os.Stderr, "ESC%c", strescseq.typ)
-	for i := 0; i < strescseq.len; i++ {
+	for i := 0; i < len(strescseq.buf); i++ {
 		c := rune(strescseq.buf[i] & 0xff)
 		switch {
 		case c == 0:
@@ -1410,72 +1955,262 @@ func selected(x, y int) bool {
 func selsnap(x, y *int, direction int) {
 	switch sel.snap {
 	case SNAP_WORD:
-		// Snap around if the word wraps around at the end or
-		// beginning of a line.
-		prevgp := &term.line[*y][*x]
-		prevdelim := isdelim(prevgp.u)
-
-		var xt, yt int
-		for {
-			newx := *x + direction
-			newy := *y
-			if 0 <= newx && newx <= term.col-1 {
-				newy += direction
-				newx = (newx + term.col) % term.col
-				if !(0 <= newy && newy <= term.row-1) {
-					break
-				}
+		if !selsnapmatch(x, y, direction) {
+			selsnapword(x, y, direction)
+		}
+	case SNAP_PAIR:
+		if !selsnappair(x, y, direction) {
+			selsnapline(x, y, direction)
+		}
+	case SNAP_LINE:
+		selsnapline(x, y, direction)
+	}
+}
 
-				if direction > 0 {
-					yt = *y
-					xt = *x
-				} else {
-					yt = newy
-					xt = newx
-				}
-				if term.line[yt][xt].mode&ATTR_WRAP == 0 {
-					break
-				}
+// selsnapword moves to the end of the word in the given direction,
+// words being separated by worddelimiters
+func selsnapword(x, y *int, direction int) {
+	// Snap around if the word wraps around at the end or
+	// beginning of a line.
+	prevgp := &tline(*y)[*x]
+	prevdelim := isdelim(prevgp.u)
+
+	var xt, yt int
+	for {
+		newx := *x + direction
+		newy := *y
+		if !(0 <= newx && newx <= term.col-1) {
+			newy += direction
+			newx = (newx + term.col) % term.col
+			if top, bot := tviewrows(); !(top <= newy && newy <= bot) {
+				break
 			}
 
-			if newx >= tlinelen(newy) {
+			if direction > 0 {
+				yt = *y
+				xt = *x
+			} else {
+				yt = newy
+				xt = newx
+			}
+			if tline(yt)[xt].mode&ATTR_WRAP == 0 {
 				break
 			}
+		}
 
-			gp := &term.line[newy][newx]
-			delim := isdelim(gp.u)
-			if (gp.mode&ATTR_WDUMMY) == 0 && (delim != prevdelim || (delim && gp.u != prevgp.u)) {
+		if newx >= tlinelen(newy) {
+			break
+		}
+
+		gp := &tline(newy)[newx]
+		delim := isdelim(gp.u)
+		if (gp.mode&ATTR_WDUMMY) == 0 && (delim != prevdelim || (delim && gp.u != prevgp.u)) {
+			break
+		}
+
+		*x = newx
+		*y = newy
+		prevgp = gp
+		prevdelim = delim
+	}
+}
+
+// selsnapline moves to the end of the line in the given direction,
+// following the rows it wraps from and into
+func selsnapline(x, y *int, direction int) {
+	// Snap around if the the previous line or the current one
+	// has set ATTR_WRAP at its end. Then the whole next or
+	// previous line will be selected.
+	*x = term.col - 1
+	if direction < 0 {
+		*x = 0
+	}
+	top, bot := tviewrows()
+	if direction < 0 {
+		for ; *y > top; *y += direction {
+			if tline(*y - 1)[term.col-1].mode&ATTR_WRAP == 0 {
+				break
+			}
+		}
+	} else if direction > 0 {
+		for ; *y < bot; *y += direction {
+			if tline(*y)[term.col-1].mode&ATTR_WRAP == 0 {
 				break
 			}
+		}
+	}
+}
+
+// tviewrows returns the first and the last row of the view there are
+// lines for, the rows above the view are in the history
+func tviewrows() (int, int) {
+	if term.mode&MODE_ALTSCREEN != 0 {
+		return 0, term.row - 1
+	}
+	return term.scr - term.histn, term.scr + term.row - 1
+}
+
+// tlogline returns the first and the last row of the view of the line
+// going through row y, the rows it wraps from and into included
+func tlogline(y int) (int, int) {
+	top, bot := tviewrows()
+	y1, y2 := y, y
+	for y1 > top && tline(y1 - 1)[term.col-1].mode&ATTR_WRAP != 0 {
+		y1--
+	}
+	for y2 < bot && tline(y2)[term.col-1].mode&ATTR_WRAP != 0 {
+		y2++
+	}
+	return y1, y2
+}
+
+// selsnapmatch moves to the end of the match of the first of snapres
+// going through the cell, it returns false if there is none
+func selsnapmatch(x, y *int, direction int) bool {
+	if snapres == nil {
+		for _, p := range snappatterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "snap pattern %q: %v\n", p, err)
+				continue
+			}
+			snapres = append(snapres, re)
+		}
+	}
 
-			*x = newx
-			*y = newy
-			prevgp = gp
-			prevdelim = delim
+	y1, y2 := tlogline(*y)
+	top := term.histn - term.scr
+	i := top + *y
+	for _, re := range snapres {
+		found := false
+		tmatches(re, top+y1, y2-y1+1, func(m SearchMatch, _ string) {
+			if found || i < m.i1 || i > m.i2 || (i == m.i1 && *x < m.x1) || (i == m.i2 && *x > m.x2) {
+				return
+			}
+			found = true
+			if direction < 0 {
+				*x, *y = m.x1, m.i1-top
+			} else {
+				*x, *y = m.x2, m.i2-top
+			}
+		})
+		if found {
+			return true
 		}
+	}
+	return false
+}
 
-	case SNAP_LINE:
-		// Snap around if the the previous line or the current one
-		// has set ATTR_WRAP at its end. Then the whole next or
-		// previous line will be selected.
-		*x = term.col - 1
-		if direction < 0 {
-			*x = 0
-		}
-		if direction < 0 {
-			for ; *y > 0; *y += direction {
-				if term.line[*y-1][term.col-1].mode&ATTR_WRAP == 0 {
-					break
+// selsnappair moves to the end of the inside of the sel.level-th pair
+// of snappairs around the cell, it returns false if there are not as
+// many
+func selsnappair(x, y *int, direction int) bool {
+	type cell struct{ x, y int }
+	var r []rune
+	var at []cell
+	y1, y2 := tlogline(*y)
+	for yy := y1; yy <= y2; yy++ {
+		for xx, g := range tline(yy) {
+			if g.mode&ATTR_WDUMMY == 0 {
+				r = append(r, g.u)
+				at = append(at, cell{xx, yy})
+			}
+		}
+	}
+	index := func(x, y int) int {
+		for k, c := range at {
+			if c.y > y || (c.y == y && c.x >= x) {
+				return k
+			}
+		}
+		return len(at) - 1
+	}
+
+	c := index(*x, *y)
+
+	// the word selected by a double click
+	wx1, wy1, wx2, wy2 := *x, *y, *x, *y
+	if !selsnapmatch(&wx1, &wy1, -1) || !selsnapmatch(&wx2, &wy2, +1) {
+		selsnapword(&wx1, &wy1, -1)
+		selsnapword(&wx2, &wy2, +1)
+	}
+	w1, w2 := index(wx1, wy1), index(wx2, wy2)
+
+	// pairs around the cell
+	type pair struct{ l, r int }
+	var pairs []pair
+	for _, p := range snappairs {
+		op, cl := []rune(p)[0], []rune(p)[1]
+		if op == cl {
+			// a quote: the nearest ones, unless that would be the
+			// text between two quoted texts
+			if r[c] == op {
+				continue
+			}
+			l, n := -1, 0
+			for k := 0; k < c; k++ {
+				if r[k] == op {
+					l = k
+					n++
 				}
 			}
-		} else if direction > 0 {
-			for ; *y < term.row-1; *y += direction {
-				if term.line[*y][term.col-1].mode&ATTR_WRAP == 0 {
+			for k := c + 1; n%2 == 1 && k < len(r); k++ {
+				if r[k] == cl {
+					pairs = append(pairs, pair{l, k})
 					break
 				}
 			}
+			continue
+		}
+
+		depth := 0
+		for l := c - 1; l >= 0; l-- {
+			switch r[l] {
+			case cl:
+				depth++
+			case op:
+				if depth > 0 {
+					depth--
+					continue
+				}
+				// the matching bracket
+				d := 0
+				for k := l + 1; k < len(r); k++ {
+					if r[k] == op {
+						d++
+					} else if r[k] == cl && d > 0 {
+						d--
+					} else if r[k] == cl {
+						if k > c {
+							pairs = append(pairs, pair{l, k})
+						}
+						break
+					}
+				}
+			}
 		}
 	}
+	sort.Slice(pairs, func(a, b int) bool {
+		return pairs[a].r-pairs[a].l < pairs[b].r-pairs[b].l
+	})
+
+	n := 0
+	for _, p := range pairs {
+		// the inside must be more than the word
+		if p.l+1 >= w1 && p.r-1 <= w2 {
+			continue
+		}
+		if n++; n < sel.level {
+			continue
+		}
+		c := at[p.l+1]
+		if direction > 0 {
+			c = at[p.r-1]
+		}
+		*x, *y = c.x, c.y
+		return true
+	}
+	return false
 }
 
 func getsel() []byte {
@@ -1495,7 +2230,7 @@ func getsel() []byte {
 			continue
 		}
 
-		gp := term.line[y]
+		gp := tline(y)
 		gpi := 0
 		lastx := 0
 		if sel.typ == SEL_RECTANGULAR {
@@ -1553,7 +2288,7 @@ func stty(args []string) {
 	cmd := exec.Command(command)
 	err := cmd.Run()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Couldn't call stty: %v", err)
+		fmt.Fprintf(os.Stderr, "Couldn't call stty: %v\n", err)
 	}
 }
 
@@ -1580,10 +2315,10 @@ func unsetenv(env []string, key string) []string {
 	return env
 }
 
-func execsh(s *os.File, cmd string, args []string) {
+func execsh(s *os.File, cmd, dir string, args []string) {
 	usr, err := posix.Getpwuid(posix.Geteuid())
 	if err != nil {
-		log.Fatal("can't get user info: %v", err)
+		log.Fatalf("can't get user info: %v", err)
 	}
 
 	sh := usr.Shell
@@ -1617,6 +2352,7 @@ func execsh(s *os.File, cmd string, args []string) {
 	exe.Stdout = s
 	exe.Stderr = s
 	exe.Env = env
+	exe.Dir = dir
 	exe.ExtraFiles = []*os.File{s}
 	exe.SysProcAttr = &syscall.SysProcAttr{
 		Setsid:  true,
@@ -1626,11 +2362,12 @@ func execsh(s *os.File, cmd string, args []string) {
 	if err != nil {
 		log.Fatalf("can't start shell: %v", err)
 	}
+	pid = exe.Process.Pid
 
 	go sigchld(exe)
 }
 
-func ttynew(line, cmd, out string, args []string) *os.File {
+func ttynew(line, cmd, dir, out string, args []string) *os.File {
 	var err error
 	if out != "" {
 		term.mode |= MODE_PRINT
@@ -1660,11 +2397,41 @@ func ttynew(line, cmd, out string, args []string) *os.File {
 		log.Fatalf("openpty failed: %v", err)
 	}
 
-	execsh(s, cmd, args)
+	execsh(s, cmd, dir, args)
 	cmdfile = m
 	return cmdfile
 }
 
+// newterm spawns a new st in the working directory of the shell
+func newterm(interface{}) {
+	dir := term.cwd
+	if dir == "" && pid != 0 {
+		// the shell never told us, ask the kernel
+		dir, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	}
+
+	prog, err := os.Executable()
+	if err != nil {
+		prog = os.Args[0]
+	}
+
+	var args []string
+	if dir != "" {
+		args = append(args, "-d", dir)
+	}
+	exe := exec.Command(prog, args...)
+	exe.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+	err = exe.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "newterm: can't start %s: %v\n", prog, err)
+		return
+	}
+
+	go exe.Wait()
+}
+
 func ttyread() int {
 	written := twrite(term.buf[:term.buflen], false)
 	term.buflen -= written
@@ -1672,6 +2439,17 @@ func ttyread() int {
 	return term.buflen
 }
 
+// ttyfeed writes data that does not come from the tty as if it did, the
+// chars split between two calls are kept in the buffer
+func ttyfeed(b []byte) {
+	for len(b) > 0 {
+		n := copy(term.buf[term.buflen:], b)
+		term.buflen += n
+		b = b[n:]
+		ttyread()
+	}
+}
+
 func tputc(u rune) {
 	var c [utf8.UTFMax]byte
 	var width, len_ int
@@ -1692,80 +2470,11 @@ func tputc(u rune) {
 		tprinter(c[:len_])
 	}
 
-	// STR sequence must be checked before anything else
-	// because it uses all following characters until it
-	// receives a ESC, a SUB, a ST or any other C1 control
-	// character.
-	if term.esc&ESC_STR != 0 {
-		if u == '\a' || u == 030 || u == 032 || u == 033 || iscontrolc1(u) {
-			term.esc &^= (ESC_START | ESC_STR | ESC_DCS)
-			if term.mode&MODE_SIXEL != 0 {
-				// TODO: render sixel
-				term.mode &^= MODE_SIXEL
-				return
-			}
-			term.esc |= ESC_STR_END
-			goto check_control_code
-		}
-
-		if term.mode&MODE_SIXEL != 0 {
-			// TODO: implement sixel mode
-			return
-		}
-		if term.esc&ESC_DCS != 0 && strescseq.len == 0 && u == 'q' {
-			term.mode |= MODE_SIXEL
-		}
-
-		if strescseq.len+len_ >= len(strescseq.buf)-1 {
-			// Here is a bug in terminals. If the user never sends
-			// some code to stop the str or esc command, then st
-			// will stop responding. But this is better than
-			// silently failing with unknown characters. At least
-			// then users will report back
-			// In this case users ever get fixed, here is the code:
-			// term.esc 0
-			// strhandle()
-			return
-		}
-		copy(strescseq.buf[strescseq.len:], c[:len_])
-		strescseq.len += len_
-		return
-	}
+	vtparse(u, width)
+}
 
-check_control_code:
-	// Actions of control codes must be performed as soon they arrive
-	// because they can be embedded inside a control sequence, and
-	// they must not cause conflicts with sequences.
-	if control {
-		tcontrolcode(u)
-		// control codes are not shown ever
-		return
-	} else if term.esc&ESC_START != 0 {
-		if term.esc&ESC_CSI != 0 {
-			csiescseq.buf[csiescseq.len], csiescseq.len = byte(u), csiescseq.len+1
-			if (0x40 <= u && u <= 0x7E) || csiescseq.len >= len(csiescseq.buf)-1 {
-				term.esc = 0
-				csiparse()
-				csihandle()
-			}
-			return
-		} else if term.esc&ESC_UTF8 != 0 {
-			tdefutf8(u)
-		} else if term.esc&ESC_ALTCHARSET != 0 {
-			tdeftran(u)
-		} else if term.esc&ESC_TEST != 0 {
-			tdectest(u)
-		} else {
-			if !eschandle(u) {
-				return
-			}
-			// sequence already finished
-		}
-		term.esc = 0
-		// All characters which form part of a sequence are not printed
-		return
-	}
-	if sel.ob.x != -1 && sel.ob.y <= term.c.y && term.c.y <= sel.oe.y {
+func tputglyph(u rune, width int) {
+	if !keepselection && sel.ob.x != -1 && sel.ob.y <= term.c.y && term.c.y <= sel.oe.y {
 		selclear()
 	}
 
@@ -1787,6 +2496,12 @@ check_control_code:
 		gp = &term.line[term.c.y][term.c.x]
 		gpu = term.line[term.c.y][term.c.x:]
 	}
+
+	// only the cells written over drop the selection
+	y := term.c.y + term.scr
+	if keepselection && (selected(term.c.x, y) || width == 2 && selected(term.c.x+1, y)) {
+		selclear()
+	}
 	tsetchar(u, &term.c.attr, term.c.x, term.c.y)
 
 	if width == 2 {
@@ -1803,14 +2518,46 @@ check_control_code:
 	}
 }
 
+func strput(u rune) {
+	var c [utf8.UTFMax]byte
+	len_ := 1
+	if term.mode&MODE_UTF8 == 0 || term.mode&MODE_SIXEL != 0 {
+		c[0] = byte(u)
+	} else {
+		len_ = utf8.EncodeRune(c[:], u)
+	}
+
+	if strescseq.overflow {
+		return
+	}
+	if len(strescseq.buf)+len_ > strbufmax {
+		// Nothing sane is that long. Drop what we have and
+		// skip everything up to the terminator, which puts
+		// us back in sync with the application.
+		fmt.Fprintf(os.Stderr, "erresc: string longer than %d bytes, ignoring\n", strbufmax)
+		strescseq.buf = nil
+		strescseq.overflow = true
+		return
+	}
+	strescseq.buf = append(strescseq.buf, c[:len_]...)
+}
+
 func strreset() {
-	strescseq = STREscape{}
+	// keep the buffer around unless an image made it grow
+	buf := strescseq.buf[:0]
+	if cap(buf) > STR_BUF_SIZ {
+		buf = make([]byte, 0, STR_BUF_SIZ)
+	}
+	strescseq = STREscape{buf: buf}
 }
 
 func sendbreak(interface{}) {
+	if cmdfile == nil {
+		return
+	}
 	err := posix.Tcsendbreak(int(cmdfile.Fd()), 0)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error sending break: %v", err)
+		fmt.Fprintf(os.Stderr, "Error sending break: %v\n", err)
 	}
 }
 
@@ -1846,16 +2593,21 @@ func tdumpsel() {
 }
 
 func tdumpline(n int) {
-	var buf [utf8.UTFMax]byte
-	bp := term.line[n]
-	end := min(tlinelen(n), term.col) - 1
-	if end > 0 || bp[0].u != ' ' {
-		for i := 0; i <= end && bp[i].u != ' '; i++ {
-			buflen := utf8.EncodeRune(buf[:], bp[i].u)
-			tprinter(buf[:buflen])
+	tprinter(append(tappendline(nil, term.line[n]), '\n'))
+}
+
+// tappendline appends the text of a line to b
+func tappendline(b []byte, l Line) []byte {
+	end := min(linelen(l), term.col) - 1
+	if end > 0 || l[0].u != ' ' {
+		for i := 0; i <= end; i++ {
+			if l[i].mode&ATTR_WDUMMY != 0 {
+				continue
+			}
+			b = utf8.AppendRune(b, l[i].u)
 		}
 	}
-	tprinter([]byte("\n"))
+	return b
 }
 
 func tdump() {
@@ -1919,16 +2671,16 @@ func tstrsequence(c rune) {
 	switch c {
 	case 0x90: // DCS -- Device Control String
 		c = 'P'
-		term.esc |= ESC_DCS
 	case 0x9f: // APC -- Application Program Command
 		c = '_'
 	case 0x9e: // PM -- Privacy Message
 		c = '^'
 	case 0x9d: // OSC -- Operating System Command
 		c = ']'
+	case 0x98: // SOS -- Start of String
+		c = 'X'
 	}
 	strescseq.typ = int(c)
-	term.esc |= ESC_STR
 }
 
 func tcontrolcode(ascii rune) {
@@ -1951,18 +2703,9 @@ func tcontrolcode(ascii rune) {
 		tnewline(term.mode&MODE_CRLF != 0)
 		return
 	case '\a': // BEL
-		if term.esc&ESC_STR_END != 0 {
-			// backwards compatibility to xterm
-			strhandle()
-		} else {
-			xbell()
-		}
-	case '\033': // ESC
-		csireset()
-		term.esc &^= (ESC_CSI | ESC_ALTCHARSET | ESC_TEST)
-		term.esc |= ESC_START
-		return
+		xbell()
 	case '\016': // SO (LS1 -- Locking shift 1)
+		fallthrough
 	case '\017': // SI (LS0 -- Locking shift 0)
 		term.charset = int(1 - (ascii - '\016'))
 		return
@@ -2025,69 +2768,54 @@ func tcontrolcode(ascii rune) {
 		fallthrough
 	case 0x97: // TODO: EPA
 		fallthrough
-	case 0x98: // TODO: SOS
-		fallthrough
 	case 0x99: // TODO: SGCI
 		break
 	case 0x9a: // DECID -- Identify Terminal
 		ttywrite(vtiden, false)
-	case 0x9b: // TODO: CSI
-		fallthrough
-	case 0x9c: // TODO: ST
-	case 0x90: // DCS -- Device Control String
-		fallthrough
-	case 0x9d: // OSC -- Operating System Command
-		fallthrough
-	case 0x9e: // PM -- Privacy Message
-		fallthrough
-	case 0x9f: // APC -- Application Program Command
-		tstrsequence(ascii)
+	}
+	// DCS, SOS, CSI, ST, OSC, PM and APC are handled by the parser
+}
+
+func escdispatch(final rune) {
+	inter := term.vt.inter
+	if len(inter) == 0 {
+		eschandle(final)
 		return
 	}
-	// only CAN, SUB, \a and C1 chars interrupt a sequence
-	term.esc &^= (ESC_STR_END | ESC_STR)
+
+	if len(inter) == 1 {
+		switch inter[0] {
+		case '(': // GZD4 -- set primary charset G0
+			fallthrough
+		case ')': // G1D4 -- set secondary charset G1
+			fallthrough
+		case '*': // G2D4 -- set tertiary charset G2
+			fallthrough
+		case '+': // G3D4 -- set quaternary charset G3
+			term.icharset = int(inter[0] - '(')
+			tdeftran(final)
+			return
+		case '%':
+			tdefutf8(final)
+			return
+		case '#':
+			tdectest(final)
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "erresc: unknown sequence ESC %s%c\n", inter, final)
 }
 
-// returns 1 when the sequence is finished and it hasn't to read
-// more characters for this sequence, otherwise 0
-func eschandle(ascii rune) bool {
+func eschandle(ascii rune) {
 	switch ascii {
-	case '[':
-		term.esc |= ESC_CSI
-		return false
-	case '#':
-		term.esc |= ESC_TEST
-		return false
-	case '%':
-		term.esc |= ESC_UTF8
-		return false
-	case 'P': // DCS -- Device Control String
-		fallthrough
-	case '_': // APC -- Application Program Command
-		fallthrough
-	case '^': // PM -- Privacy Message
-		fallthrough
-	case ']': // OSC -- Operating System Command
-		fallthrough
-	case 'k': // old title set compatibility
-		tstrsequence(ascii)
-		return false
 	case 'n': // LS2 -- Locking shift 2
+		fallthrough
 	case 'o': // LS3 -- Locking shift 3
 		term.charset = int(2 + (ascii - 'n'))
-	case '(': // GZD4 -- set primary charset G0
-		fallthrough
-	case ')': // G1D4 -- set secondary charset G1
-		fallthrough
-	case '*': // G2D4 -- set tertiary charset G2
-		fallthrough
-	case '+': // G3D4 -- set quaternary charset G3
-		term.icharset = int(ascii - '(')
-		term.esc |= ESC_ALTCHARSET
-		return false
 	case 'D': // IND -- Linefeed
 		if term.c.y == term.bot {
-			tscrollup(term.top, 1)
+			tscrollup(term.top, 1, true)
 		} else {
 			tmoveto(term.c.x, term.c.y+1)
 		}
@@ -2116,7 +2844,9 @@ func eschandle(ascii rune) bool {
 	case '8': // DECRC -- Restore Cursor
 		tcursor(CURSOR_LOAD)
 	case '\\': // ST -- String Terminator
-		if term.esc&ESC_STR_END != 0 {
+		// the ESC ending a string is only a terminator when
+		// followed by a backslash
+		if term.vt.strend {
 			strhandle()
 		}
 	default:
@@ -2126,7 +2856,6 @@ func eschandle(ascii rune) bool {
 		}
 		fmt.Fprintf(os.Stderr, "erresc: unknown sequence ESC 0x%02X '%c'\n", ascii, char)
 	}
-	return true
 }
 
 func twrite(buf []byte, show_ctrl bool) int {
@@ -2138,10 +2867,12 @@ func twrite(buf []byte, show_ctrl bool) int {
 	for ; n < len(buf); n += charsize {
 		if term.mode&MODE_UTF8 != 0 && term.mode&MODE_SIXEL == 0 {
 			// process a complete utf8 char
-			u, charsize = utf8.DecodeRune(buf[n:])
-			if charsize == 0 || u == utf8.RuneError {
+			if !utf8.FullRune(buf[n:]) {
+				// wait for the rest of the char
 				break
 			}
+			// invalid sequences decode to U+FFFD a byte at a time
+			u, charsize = utf8.DecodeRune(buf[n:])
 		} else {
 			u = rune(buf[n]) & 0xff
 			charsize = 1
@@ -2169,7 +2900,11 @@ func drawregion(x1, y1, x2, y2 int) {
 		}
 
 		term.dirty[y] = false
-		xdrawline(term.line[y], x1, y, x2)
+		line := tline(y)
+		if hints.active {
+			line = hintline(line, y)
+		}
+		xdrawline(line, x1, y, x2)
 	}
 }
 
@@ -2190,8 +2925,16 @@ func draw() {
 	}
 
 	drawregion(0, 0, term.col, term.row)
-	xdrawcursor(cx, term.c.y, term.line[term.c.y][cx],
-		term.ocx, term.ocy, term.line[term.ocy][term.ocx])
+	if copymode.active {
+		// the lines under the old and the new cursor are dirty
+		copymode.x = clamp(copymode.x, 0, term.col-1)
+		copymode.y = clamp(copymode.y, 0, term.row-1)
+		g := tline(copymode.y)[copymode.x]
+		xdrawcursor(copymode.x, copymode.y, g, copymode.x, copymode.y, g)
+	} else if term.scr == 0 {
+		xdrawcursor(cx, term.c.y, term.line[term.c.y][cx],
+			term.ocx, term.ocy, term.line[term.ocy][term.ocx])
+	}
 	term.ocx = cx
 	term.ocy = term.c.y
 	xfinishdraw()
@@ -2209,6 +2952,7 @@ func trun() {
 		if err != nil {
 			log.Fatalf("couldn't read from shell: %v", err)
 		}
+		recoutput(term.buf[term.buflen : term.buflen+nr])
 		term.buflen += nr
 		term.rdy <- struct{}{}
 		<-term.rdy
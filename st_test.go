@@ -0,0 +1,1055 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// The tests drive the terminal core the way the tty does, through
+// twrite, and look at the screen, the cursor, the modes and what is
+// written back to the application. They never reach the X front end.
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var ttyreply *os.File // read end of the pipe replacing the tty
+
+// testterm sets up a terminal of col x row cells
+func testterm(t *testing.T, col, row int) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdfile, ttyreply = w, r
+	t.Cleanup(func() {
+		w.Close()
+		r.Close()
+	})
+
+	win.mode = 0
+	win.cw, win.ch = 0, 0 // no font is loaded without X
+	imgreset()
+	selinit()
+	tnew(col, row)
+}
+
+func feed(t *testing.T, s string) {
+	t.Helper()
+	if n := twrite([]byte(s), false); n != len(s) {
+		t.Fatalf("twrite(%q) consumed %d bytes of %d", s, n, len(s))
+	}
+}
+
+// replies returns what the terminal wrote to the application so far
+func replies(t *testing.T) string {
+	t.Helper()
+	cmdfile.Close()
+	b, err := io.ReadAll(ttyreply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttyreply.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdfile, ttyreply = w, r
+	return string(b)
+}
+
+// screen renders the screen as text, followed by the cursor position
+func screen() string {
+	var sb strings.Builder
+	for y := 0; y < term.row; y++ {
+		var l []rune
+		for _, g := range term.line[y] {
+			switch {
+			case g.mode&ATTR_WDUMMY != 0:
+			case g.u == 0:
+				l = append(l, ' ')
+			default:
+				l = append(l, g.u)
+			}
+		}
+		sb.WriteString(strings.TrimRight(string(l), " "))
+		sb.WriteString("|\n")
+	}
+	fmt.Fprintf(&sb, "cursor %d,%d\n", term.c.x, term.c.y)
+	return sb.String()
+}
+
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s: screen differs\ngot:\n%swant:\n%s", name, got, want)
+	}
+}
+
+// fill writes a letter on every line, each line made of its own letter
+const fill = "aaaaaaaaaa\r\nbbbbbbbbbb\r\ncccccccccc\r\ndddddddddd\r\neeeeeeeeee"
+
+var screentests = []struct {
+	name string
+	in   string
+}{
+	{"cursor", "\033[3;4Hx\033[2Ay\033[5Bz\033[3D<\033[2C>\033[1;1H\033[Aa"},
+	{"cursor-clamp", "\033[99;99H1\033[99D2\033[99A3\033[99;99f4"},
+	{"cursor-col-row", "\033[4Gx\033[3dy\033[2Ez\033[F!\033[2`@"},
+	{"ed-below", fill + "\033[3;5H\033[J"},
+	{"ed-above", fill + "\033[3;5H\033[1J"},
+	{"ed-above-row1", fill + "\033[2;5H\033[1J"},
+	{"ed-all", fill + "\033[3;5H\033[2J"},
+	{"el-right", fill + "\033[2;5H\033[K"},
+	{"el-left", fill + "\033[2;5H\033[1K"},
+	{"el-all", fill + "\033[2;5H\033[2K"},
+	{"ech", fill + "\033[2;3H\033[4X"},
+	{"ich", "abcdef\033[1;3H\033[2@"},
+	{"dch", "abcdef\033[1;2H\033[2P"},
+	{"il", fill + "\033[2;5H\033[2L"},
+	{"dl", fill + "\033[2;5H\033[2M"},
+	{"irm", "abcdef\033[1;3H\033[4hXY\033[4lZ"},
+	{"scroll-region", fill + "\033[2;4r\033[4;1H\n\nx"},
+	{"scroll-region-ri", fill + "\033[2;4r\033[2;1H\033Mx"},
+	{"su-sd", fill + "\033[2S\033[5;1H\033[1T"},
+	{"decom", fill + "\033[2;4r\033[?6h\033[1;1Hx\033[9;9Hy\033[?6l\033[r"},
+	{"wrap", "0123456789abc"},
+	{"nowrap", "\033[?7l0123456789abc"},
+	{"wrap-wide", "012345678日x"},
+	{"tabs", "\tx\033[1;2H\033H\r\ty\033[2;1H\t\tz\033[Z!"},
+	{"tabs-clear", "\033[3g\ta\r\n\033[1;4H\033H\r\tb"},
+	{"charset", "\033(0lqk\r\nx x\r\nmqj\033(Bq"},
+	{"charset-shift", "\033)0a\016lqk\017a"},
+	{"decaln", "\033#8\033[2;2H\033[1K"},
+	{"cursor-save", "ab\0337\033[3;3Hcd\0338ef\033[s\033[5;5H\033[ug"},
+	{"altscreen", "main\033[?1049halt\033[?1049l!"},
+	{"c1", "\u009b2;3Hx\u0090q#0~\u009cy"},
+	{"sequence-split", "\033[2;\0335H\033[;3Hx"},
+}
+
+func TestScreen(t *testing.T) {
+	for _, tt := range screentests {
+		t.Run(tt.name, func(t *testing.T) {
+			testterm(t, 10, 5)
+			feed(t, tt.in)
+			golden(t, "screen-"+tt.name, screen())
+		})
+	}
+}
+
+func TestFeedBytewise(t *testing.T) {
+	// sequences split over several reads give the same screen
+	for _, tt := range screentests {
+		testterm(t, 10, 5)
+		feed(t, tt.in)
+		want := screen()
+
+		testterm(t, 10, 5)
+		for i := 0; i < len(tt.in); {
+			n := twrite([]byte(tt.in[i:min(i+1, len(tt.in))]), false)
+			if n == 0 {
+				// incomplete utf8, give it the rest of the rune
+				n = twrite([]byte(tt.in[i:min(i+4, len(tt.in))]), false)
+			}
+			i += n
+		}
+		if got := screen(); got != want {
+			t.Errorf("%s: bytewise\n%s\nall at once\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func TestIncompleteUTF8(t *testing.T) {
+	testterm(t, 10, 5)
+	s := []byte("a日")
+	if n := twrite(s[:2], false); n != 1 {
+		t.Errorf("twrite consumed %d bytes, want 1", n)
+	}
+	if n := twrite(s[1:], false); n != 3 {
+		t.Errorf("twrite consumed %d bytes, want 3", n)
+	}
+	golden(t, "screen-utf8", screen())
+}
+
+func TestSGR(t *testing.T) {
+	tests := []struct {
+		in     string
+		mode   uint
+		fg, bg uint32
+	}{
+		{"\033[1;3;4;7m", ATTR_BOLD | ATTR_ITALIC | ATTR_UNDERLINE | ATTR_REVERSE, defaultfg, defaultbg},
+		{"\033[1;2m\033[22m", 0, defaultfg, defaultbg},
+		{"\033[9;5m\033[29m", ATTR_BLINK, defaultfg, defaultbg},
+		{"\033[31;42m", 0, 1, 2},
+		{"\033[91;102m", 0, 9, 10},
+		{"\033[31;42m\033[39;49m", 0, defaultfg, defaultbg},
+		{"\033[38;5;200;48;5;17m", 0, 200, 17},
+		{"\033[38;2;1;2;3m", 0, uint32(truecolor(1, 2, 3)), defaultbg},
+		{"\033[38:2::1:2:3;48:5:99m", 0, uint32(truecolor(1, 2, 3)), 99},
+		{"\033[38:2:4:5:6m", 0, uint32(truecolor(4, 5, 6)), defaultbg},
+		{"\033[4:3m", ATTR_UNDERLINE, defaultfg, defaultbg},
+		{"\033[4m\033[4:0m", 0, defaultfg, defaultbg},
+		{"\033[1;31m\033[m", 0, defaultfg, defaultbg},
+		{"\033[1;31m\033[0m", 0, defaultfg, defaultbg},
+	}
+	for _, tt := range tests {
+		testterm(t, 10, 5)
+		feed(t, tt.in+"x")
+		g := term.line[0][0]
+		if g.u != 'x' || g.mode != tt.mode || g.fg != tt.fg || g.bg != tt.bg {
+			t.Errorf("%q: got mode %#x fg %d bg %d, want mode %#x fg %d bg %d",
+				tt.in, g.mode, g.fg, g.bg, tt.mode, tt.fg, tt.bg)
+		}
+	}
+}
+
+func TestReplies(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"\033[c", string(vtiden)},
+		{"\033[0c", string(vtiden)},
+		{"\033Z", string(vtiden)},
+		{"\u009a", string(vtiden)},
+		{"\033[>c", ""},
+		{"\033[3;5H\033[6n", "\033[3;5R"},
+		{"\u009b2;7H\u009b6n", "\033[2;7R"},
+		{"\033[5n", ""},
+	}
+	for _, tt := range tests {
+		testterm(t, 10, 5)
+		feed(t, tt.in)
+		if got := replies(t); got != tt.out {
+			t.Errorf("%q: replied %q, want %q", tt.in, got, tt.out)
+		}
+	}
+}
+
+func TestPasteFilter(t *testing.T) {
+	defer func(f int) { pastefilter = f }(pastefilter)
+
+	in := "ls\tx\r\033[201~rm\u009b201~\a"
+	tests := []struct {
+		filter int
+		brckt  bool
+		out    string
+	}{
+		{PASTE_KEEP, false, in},
+		{PASTE_KEEP, true, "ls\tx\rrm\a"},
+		{PASTE_STRIP, true, "ls\tx\r[201~rm201~"},
+		{PASTE_CARET, false, "ls\tx\r^[[201~rm^[[201~^G"},
+	}
+	for _, tt := range tests {
+		pastefilter = tt.filter
+		if got := string(tfilterpaste([]byte(in), tt.brckt)); got != tt.out {
+			t.Errorf("filter %d, bracketed %v: got %q, want %q", tt.filter, tt.brckt, got, tt.out)
+		}
+	}
+
+	// a lone 8-bit C1 byte, not utf8
+	for _, tt := range []struct {
+		filter int
+		out    string
+	}{
+		{PASTE_KEEP, "a\x9b2Jb"},
+		{PASTE_STRIP, "a2Jb"},
+		{PASTE_CARET, "a^[[2Jb"},
+	} {
+		pastefilter = tt.filter
+		if got := string(tfilterpaste([]byte("a\x9b2Jb"), false)); got != tt.out {
+			t.Errorf("filter %d, raw C1: got %q, want %q", tt.filter, got, tt.out)
+		}
+	}
+
+	// an end of paste made of the parts around another
+	pastefilter = PASTE_KEEP
+	for _, in := range []string{"\033[20\033[201~1~", "\033[20\u009b201~1~"} {
+		if got := string(tfilterpaste([]byte(in), true)); got != "" {
+			t.Errorf("bracketed %q: got %q, want \"\"", in, got)
+		}
+	}
+}
+
+func TestCopyMode(t *testing.T) {
+	testterm(t, 20, 4)
+	defer func() { copymode = CopyMode{} }()
+
+	// the first two lines go to the history
+	feed(t, "one two\r\nthree.four\r\nl3\r\nl4\r\nl5\r\nl6")
+	copymodestart(nil)
+
+	steps := []struct {
+		keys      string
+		x, y, scr int
+	}{
+		{"0", 0, 3, 0},
+		{"gg", 0, 0, 2},
+		{"w", 4, 0, 2},
+		{"e", 6, 0, 2},
+		{"b", 4, 0, 2},
+		{"vj", 4, 1, 2},
+		{"e", 5, 1, 2},
+		{"$", 9, 1, 2},
+		{"h", 8, 1, 2},
+		{"G", 0, 3, 0},
+		{"k", 0, 2, 0},
+	}
+	for _, s := range steps {
+		for _, k := range s.keys {
+			copymodekey(string(k))
+		}
+		if copymode.x != s.x || copymode.y != s.y || term.scr != s.scr {
+			t.Fatalf("after %q: cursor %d,%d scrolled %d, want %d,%d scrolled %d",
+				s.keys, copymode.x, copymode.y, term.scr, s.x, s.y, s.scr)
+		}
+		if s.keys == "e" && s.y == 1 {
+			if got := string(getsel()); got != "two\nthree." {
+				t.Errorf("selection %q, want %q", got, "two\nthree.")
+			}
+		}
+	}
+
+	copymodekey("\033")
+	if sel.ob.x != -1 || !copymode.active {
+		t.Errorf("escape should only drop the selection")
+	}
+	copymodekey("q")
+	if copymode.active {
+		t.Errorf("still in copy mode after q")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	testterm(t, 10, 4)
+	defer searchstop()
+
+	// the match on the wrapped line goes on in the next one
+	feed(t, "foo bar\r\nxx Foobarfoo\r\nbaz\r\nqux")
+	searchstart(-1)
+	for _, k := range "foo" {
+		searchkey(string(k))
+	}
+	want := []SearchMatch{{0, 0, 2, 0}, {3, 1, 5, 1}, {9, 1, 1, 2}}
+	if fmt.Sprint(search.matches) != fmt.Sprint(want) {
+		t.Fatalf("matches %v, want %v", search.matches, want)
+	}
+	if search.cur != 2 {
+		t.Errorf("current match %d, want 2", search.cur)
+	}
+	if searchattr(9, 0) != ATTR_HIGHLIGHT|ATTR_HIGHLIGHT_CUR || searchattr(3, 0) != ATTR_HIGHLIGHT ||
+		searchattr(6, 0) != 0 {
+		t.Errorf("wrong highlights on the first line of the view")
+	}
+
+	searchkey("\016")
+	if search.cur != 1 {
+		t.Errorf("current match %d after ctrl-n, want 1", search.cur)
+	}
+	searchkey("\024")
+	if len(search.matches) != 2 {
+		t.Errorf("%d matches matching the case, want 2", len(search.matches))
+	}
+
+	searchkey("\025")
+	for _, k := range `o+b` {
+		searchkey(string(k))
+	}
+	if len(search.matches) != 0 {
+		t.Errorf("literal pattern matched as a regexp")
+	}
+	searchkey("\022")
+	if !searchselect() || string(getsel()) != "oob" {
+		t.Errorf("selected %q, want %q", getsel(), "oob")
+	}
+	if search.active {
+		t.Errorf("search still active after selecting")
+	}
+}
+
+func TestHints(t *testing.T) {
+	testterm(t, 20, 4)
+	defer hintstop()
+
+	feed(t, "see https://a.b/c.\r\nat 1a2b3c4 in ./st.go")
+	hintstart(HINT_PASTE)
+	var got []string
+	for _, h := range hints.list {
+		got = append(got, h.label+" "+h.text)
+	}
+	want := []string{"a https://a.b/c", "s 1a2b3c4", "d ./st.go"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("hints %q, want %q", got, want)
+	}
+
+	l := hintline(tline(1), 1)
+	if l[3].u != 's' || l[3].mode&ATTR_HIGHLIGHT_CUR == 0 || l[4].mode&ATTR_HIGHLIGHT == 0 ||
+		tline(1)[3].u != '1' {
+		t.Errorf("label not drawn over a copy of the line")
+	}
+
+	hintkey("x")
+	if !hints.active {
+		t.Fatalf("hint mode left on a key matching no label")
+	}
+	hintkey("d")
+	if hints.active {
+		t.Errorf("hint mode still active")
+	}
+	if got := replies(t); got != "./st.go" {
+		t.Errorf("typed %q, want %q", got, "./st.go")
+	}
+}
+
+func TestIncr(t *testing.T) {
+	defer func() { incrs = nil }()
+	// st pasting its own selection is the requestor, its window gets
+	// the property deleted as any other
+	const self, other, prop, typ = 1, 2, 3, 4
+	incrstart(other, prop, typ, []byte("other"))
+	incrstart(self, prop, typ, []byte("abcdefghij"))
+
+	var got []string
+	for {
+		chunk, tr := incrnext(self, prop, 4)
+		if tr == nil {
+			t.Fatalf("transfer lost after %q", got)
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		got = append(got, string(chunk))
+	}
+	if strings.Join(got, "|") != "abcd|efgh|ij" {
+		t.Errorf("chunks %q", got)
+	}
+	if incrbusy(self) || !incrbusy(other) {
+		t.Errorf("transfers left %v", incrs)
+	}
+
+	// the requestor that stopped reading
+	incrs[0].last = time.Now().Add(-incrtimeout)
+	if idle := incrgc(); len(idle) != 1 || idle[0] != other || len(incrs) != 0 {
+		t.Errorf("idle requestors %v, transfers left %v", idle, incrs)
+	}
+}
+
+func TestExternalPipe(t *testing.T) {
+	testterm(t, 5, 3)
+	feed(t, "one\r\n0123456789\r\nend")
+
+	tests := []struct {
+		hist bool
+		want string
+	}{
+		{false, "0123456789\nend\n"},
+		{true, "one\n0123456789\nend\n"},
+	}
+	for _, tt := range tests {
+		externalpipe(ExternalPipe{cmd: []string{"cat"}, hist: tt.hist, reply: true})
+		select {
+		case b := <-piperead:
+			// the last newline is dropped
+			if string(b)+"\n" != tt.want {
+				t.Errorf("history %v: got %q, want %q", tt.hist, b, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no output from the command")
+		}
+	}
+}
+
+func TestSnap(t *testing.T) {
+	testterm(t, 40, 4)
+
+	feed(t, "ls \"foo bar\" (a [b] c)\r\nsee https://x.org/a_b. or me@x.org\r\n")
+	feed(t, strings.Repeat(" ", 36)+"wrapword")
+	tests := []struct {
+		x, y, snap, level int
+		want              string
+	}{
+		{5, 0, SNAP_WORD, 0, `"foo`},
+		{5, 0, SNAP_PAIR, 1, "foo bar"},
+		{5, 0, SNAP_PAIR, 2, `ls "foo bar" (a [b] c)`},
+		{17, 0, SNAP_PAIR, 1, "a [b] c"},
+		{14, 1, SNAP_WORD, 0, "https://x.org/a_b"},
+		{28, 1, SNAP_WORD, 0, "me@x.org"},
+		{1, 3, SNAP_WORD, 0, "wrapword"},
+		{2, 0, SNAP_LINE, 0, `ls "foo bar" (a [b] c)`},
+	}
+	for _, tt := range tests {
+		sel.level = tt.level
+		selstart(tt.x, tt.y, tt.snap)
+		if got := string(bytes.TrimSuffix(getsel(), []byte("\n"))); got != tt.want {
+			t.Errorf("snap %d level %d at %d,%d: got %q, want %q",
+				tt.snap, tt.level, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	testterm(t, 12, 3)
+	feed(t, "\033[1;31mred\033[m <b>&\r\n\033[4;44mblue\033[m\033[7m!\033[m\r\n\033[38;2;1;2;3mrgb")
+
+	lines := exportlines(false)
+	golden(t, "export-html", string(exporthtml(lines)))
+	golden(t, "export-svg", string(exportsvg(lines)))
+	golden(t, "export-ansi", string(exportansi(lines)))
+
+	odir := exportdir
+	exportdir = t.TempDir()
+	defer func() { exportdir = odir }()
+	a, err := exportfile([]byte("a"), ".ans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := exportfile([]byte("b"), ".ans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Errorf("two exports written to %s", a)
+	}
+	if fi, err := os.Stat(a); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("export %s has mode %v", a, fi.Mode())
+	}
+}
+
+func TestRecordInput(t *testing.T) {
+	testterm(t, 10, 4)
+	defer func(b bool) { recordinput = b }(recordinput)
+	recordinput = true
+
+	path := filepath.Join(t.TempDir(), "cast")
+	if err := recopen(path, 10, 4); err != nil {
+		t.Fatal(err)
+	}
+	ttywrite([]byte("ls\r"), true)
+	feed(t, "\033[6n")
+	recmu.Lock()
+	rec.f.Close()
+	rec = nil
+	recmu.Unlock()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("recording %s has mode %v", path, fi.Mode())
+	}
+	if !bytes.Contains(b, []byte(`"i", "ls\r"`)) || bytes.Contains(b, []byte(`"i", "\u001b[1;1R"`)) {
+		t.Errorf("recorded %s", b)
+	}
+}
+
+func TestPlaySeek(t *testing.T) {
+	testterm(t, 10, 3)
+	player = &Player{speed: 1, ev: []PlayEvent{{
+		t:    time.Second,
+		data: []byte("1\r\n2\r\n3\r\n4\033[?2004h\033]0;title\a\033_Ga=T,q=2,f=24,s=2,v=2;AAAAAAAAAAAAAAAA\033\\"),
+	}}}
+	defer func() { player = nil }()
+
+	playseek(2 * time.Second)
+	if term.histn == 0 || len(kittyimages) == 0 || win.mode&MODE_BRCKTPASTE == 0 {
+		t.Fatalf("not played: %d lines of history, %d images, mode %#x",
+			term.histn, len(kittyimages), win.mode)
+	}
+	playseek(0)
+	if term.histn != 0 || len(kittyimages) != 0 || len(placements) != 0 || win.mode&MODE_BRCKTPASTE != 0 {
+		t.Errorf("seeking back kept %d lines of history, %d images, %d placements, mode %#x",
+			term.histn, len(kittyimages), len(placements), win.mode)
+	}
+}
+
+func TestInlineImage(t *testing.T) {
+	testterm(t, 10, 4)
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	data := base64.StdEncoding.EncodeToString(b.Bytes())
+	feed(t, fmt.Sprintf("\033]1337;File=name=eC5wbmc=;size=%d;width=3;height=2;preserveAspectRatio=0;inline=1:%s\a",
+		b.Len(), data))
+
+	id := term.line[0][0].img
+	p := placements[id]
+	if id == 0 || p == nil {
+		t.Fatal("no image placed")
+	}
+	if p.cols != 3 || p.rows != 2 || p.aspect {
+		t.Errorf("placed in %dx%d cells, aspect %v, want 3x2 without", p.cols, p.rows, p.aspect)
+	}
+	if term.line[1][2].img != id || term.line[1][3].img != 0 {
+		t.Errorf("the cells do not show the image")
+	}
+}
+
+func TestKittyStorage(t *testing.T) {
+	testterm(t, 10, 4)
+	omax := imgmaxstorage
+	imgmaxstorage = 2 * 4 * 4 * 4 // two 4x4 images
+	defer func() { imgmaxstorage = omax }()
+
+	px := strings.Repeat("A", 64) // 4x4 RGB
+	for i := 1; i <= 3; i++ {
+		feed(t, fmt.Sprintf("\033_Ga=t,q=2,i=%d,f=24,s=4,v=4;%s\033\\", i, px))
+	}
+	if kittyimages[1] != nil || kittyimages[2] == nil || kittyimages[3] == nil {
+		t.Errorf("the oldest image is not the one evicted")
+	}
+
+	feed(t, "\033_Ga=p,q=2,i=2\033\\\033[2J")
+	imggc()
+	if kittyimages[2] != nil || kittyimages[3] == nil {
+		t.Errorf("the image not shown anymore is not freed")
+	}
+	if imgstored != 4*4*4 {
+		t.Errorf("%d bytes stored, want %d", imgstored, 4*4*4)
+	}
+}
+
+func TestImageStorage(t *testing.T) {
+	testterm(t, 10, 4)
+	omax := imgmaxstorage
+	imgmaxstorage = 3 * 4 * 4 * 4 // three 4x4 images
+	defer func() { imgmaxstorage = omax }()
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	inline := fmt.Sprintf("\033]1337;File=width=1;height=1;inline=1:%s\a",
+		base64.StdEncoding.EncodeToString(b.Bytes()))
+
+	feed(t, inline+inline)
+	first, second := term.line[0][0].img, term.line[0][1].img
+	imgscaled(placements[first], 2, 2) // 16 bytes
+	imgscaled(placements[second], 2, 2)
+	if imgstored != 2*64+2*16 {
+		t.Errorf("%d bytes stored, want %d", imgstored, 2*64+2*16)
+	}
+
+	// the third image takes the place of the least recently used one
+	// and of its scaled copy
+	feed(t, inline)
+	if placements[first] != nil || placements[second] == nil || placements[second].pix == nil {
+		t.Errorf("the least recently used image is kept, or another one dropped")
+	}
+	if imgstored > imgmaxstorage {
+		t.Errorf("%d bytes stored past %d", imgstored, imgmaxstorage)
+	}
+
+	// the copies out of the view are dropped
+	feed(t, "\r\n\r\n\r\n\r\n")
+	imggc()
+	if placements[second] == nil || placements[second].pix != nil {
+		t.Errorf("the scaled copy out of the view is kept")
+	}
+}
+
+func TestKittyFiles(t *testing.T) {
+	testterm(t, 10, 4)
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	send := func(medium, path string) {
+		t.Helper()
+		imgreset()
+		feed(t, fmt.Sprintf("\033_Ga=t,q=2,i=1,t=%s,f=24,s=2,v=2;%s\033\\",
+			medium, base64.StdEncoding.EncodeToString([]byte(path))))
+	}
+	exists := func(path string) bool {
+		_, err := os.Lstat(path)
+		return err == nil
+	}
+
+	img := filepath.Join(dir, "tty-graphics-protocol-img")
+	if err := os.WriteFile(img, make([]byte, 12), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "tty-graphics-protocol-link")
+	if err := os.Symlink(img, link); err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fifo is never opened for good, nothing writes to it
+	send("f", fifo)
+	if kittyimages[1] != nil {
+		t.Errorf("image read from a fifo")
+	}
+	send("t", link)
+	if kittyimages[1] != nil || !exists(link) || !exists(img) {
+		t.Errorf("image read through a link, or the link removed")
+	}
+	send("t", img)
+	if kittyimages[1] == nil || exists(img) {
+		t.Errorf("temporary file not read and removed")
+	}
+}
+
+func TestKeepSelection(t *testing.T) {
+	testterm(t, 10, 4)
+
+	feed(t, "one\r\ntwo\r\nthree")
+	check := func(when, want string) {
+		t.Helper()
+		if got := string(getsel()); got != want {
+			t.Errorf("selection %s: got %q, want %q", when, got, want)
+		}
+	}
+	selstart(0, 1, 0)
+	selextend(2, 1, SEL_REGULAR, false)
+
+	feed(t, "\r\nfour\r\nfive\r\nsix")
+	check("scrolled into the history", "two")
+	kscrollup(2)
+	check("with the view scrolled", "two")
+	feed(t, "\r\nseven")
+	check("scrolled with the view scrolled", "two")
+	kscrolldown(term.scr)
+	feed(t, "\033[1;4r\033[4H\r\n")
+	check("scrolled in the region", "two")
+
+	// written over
+	feed(t, "\033[4Habc")
+	selstart(0, 3, 0)
+	selextend(2, 3, SEL_REGULAR, false)
+	check("at the bottom", "abc")
+	feed(t, "\033[4;2Hx")
+	check("written over", "")
+
+	// the resize drops the lines above the cursor
+	feed(t, "\033[3Hxyz\033[4H")
+	selstart(0, 2, 0)
+	selextend(2, 2, SEL_REGULAR, false)
+	tresize(10, 2)
+	check("resized", "xyz")
+
+	keepselection = false
+	defer func() { keepselection = true }()
+	selstart(0, 0, 0)
+	selextend(2, 0, SEL_REGULAR, false)
+	feed(t, "\033[4H\r\n")
+	check("not kept", "")
+}
+
+func TestConfig(t *testing.T) {
+	ofont, ocolors, otabs, oblink, ofps, ohist := font, colorname, tabspaces, blinktimeout, xfps, histsize
+	osc, okey, oms, opaste := shortcuts, key, mshortcuts, pastefilter
+	t.Cleanup(func() {
+		font, colorname, tabspaces, blinktimeout, xfps, histsize = ofont, ocolors, otabs, oblink, ofps, ohist
+		shortcuts, key, mshortcuts, pastefilter = osc, okey, oms, opaste
+	})
+	colorname = append([]string(nil), colorname...)
+
+	errs := confparse("config", `# st
+font = "Mono:pixelsize=14" # the font
+tabspaces = 4
+colorname = [
+	"#000000",
+	'#ff0000',
+]
+color257 = "#123456"
+blinktimeout = "500ms"
+xfps = 60
+pastefilter = "caret"
+tabspaces = "8"
+nosuch = 1
+tabspaces = 0
+xfps = 0
+histsize = -1
+cwscale = 0
+defaultbg = 100000
+hintalphabet = "a"
+hintalphabet = "abca"
+
+[[shortcut]]
+mod = "Control|Shift"
+keysym = "K"
+action = "hintstart"
+arg = "copy"
+
+[[shortcut]]
+keysym = "F5"
+action = "export"
+format = "svg"
+clipboard = true
+
+[[key]]
+keysym = "BackSpace"
+string = "\e\b\u00e9"
+
+[[mshortcut]]
+button = 4
+mod = "Hyper"
+string = "x"
+
+[[shortcut]]
+keysym = "F1"
+`)
+
+	if font != "Mono:pixelsize=14" || tabspaces != 4 || blinktimeout != 500*time.Millisecond || xfps != 60 || histsize != ohist {
+		t.Errorf("font %q, tabspaces %d, blinktimeout %v, xfps %d, histsize %d", font, tabspaces, blinktimeout, xfps, histsize)
+	}
+	if colorname[0] != "#000000" || colorname[1] != "#ff0000" || colorname[2] != ocolors[2] || colorname[257] != "#123456" {
+		t.Errorf("colorname %q", colorname[:3])
+	}
+	if pastefilter != PASTE_CARET {
+		t.Errorf("pastefilter %d", pastefilter)
+	}
+
+	if len(shortcuts) != len(osc)+2 {
+		t.Fatalf("%d shortcuts, want %d", len(shortcuts), len(osc)+2)
+	}
+	if s := shortcuts[0]; s.mod != TERMMOD || s.keysym != 'K' || s.arg != HINT_COPY {
+		t.Errorf("shortcut %+v", s)
+	}
+	if s := shortcuts[1]; s.mod != XK_NO_MOD || s.arg != (Export{format: EXPORT_SVG, clip: true}) {
+		t.Errorf("shortcut %+v", s)
+	}
+	if k := key[0]; len(key) != len(okey)+1 || k.s != "\033\bé" {
+		t.Errorf("key %+v", k)
+	}
+	if len(mshortcuts) != len(oms) {
+		t.Errorf("the mouse shortcut with an error was added")
+	}
+
+	want := []string{
+		"config:12: tabspaces: want an integer",
+		"config:13: unknown setting nosuch",
+		"config:14: tabspaces: want a value from 1 to 255",
+		"config:15: xfps: want a value from 1 to 1000",
+		"config:16: histsize: want a value from 0 to 1048576",
+		"config:17: cwscale: want a value above 0 up to 10",
+		fmt.Sprintf("config:18: defaultbg: want a color index below %d", len(colorname)),
+		"config:19: hintalphabet: want at least 2 chars",
+		"config:20: hintalphabet: 'a' is twice in the alphabet",
+		"config:40: mod: unknown modifier \"Hyper\"",
+		"config:43: [[shortcut]] without an action",
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("errors %q, want %q", errs, want)
+	}
+	for i := range want {
+		if errs[i].Error() != want[i] {
+			t.Errorf("error %q, want %q", errs[i], want[i])
+		}
+	}
+}
+
+func TestXresources(t *testing.T) {
+	ofont, ocolors, oborder, oblink, ofg, obg, otabs := font, colorname, borderpx, blinktimeout, defaultfg, defaultbg, tabspaces
+	t.Cleanup(func() {
+		font, colorname, borderpx, blinktimeout, defaultfg, defaultbg, tabspaces = ofont, ocolors, oborder, oblink, ofg, obg, otabs
+	})
+	colorname = append([]string(nil), colorname...)
+
+	errs := xrmload(`! comment
+*font:	Loose:pixelsize=10
+St.font:	Class:pixelsize=11
+st.font:	Name:pixelsize=12
+other.font:	Other:pixelsize=13
+*color1:	#aa0000
+st*color1:	#bb0000
+*.color2:	#00aa00
+St.borderpx:	5
+st.blinktimeout:	250
+*foreground:	#dddddd
+st.cwscale:	wide
+st.tabspaces:	0
+`, "st", "St")
+
+	if font != "Name:pixelsize=12" {
+		t.Errorf("font %q", font)
+	}
+	if colorname[1] != "#bb0000" || colorname[2] != "#00aa00" || colorname[3] != ocolors[3] {
+		t.Errorf("colors %q", colorname[:4])
+	}
+	if borderpx != 5 || blinktimeout != 250*time.Millisecond {
+		t.Errorf("borderpx %d, blinktimeout %v", borderpx, blinktimeout)
+	}
+	if defaultfg < 256 || colorname[defaultfg] != "#dddddd" || colorname[7] != ocolors[7] || defaultbg != obg {
+		t.Errorf("foreground %d %q", defaultfg, colorname[defaultfg])
+	}
+	if len(errs) != 2 || errs[0].Error() != "st.cwscale: want a number" ||
+		errs[1].Error() != "st.tabspaces: want a value from 1 to 255" || tabspaces != otabs {
+		t.Errorf("errors %q", errs)
+	}
+}
+
+func TestModes(t *testing.T) {
+	testterm(t, 10, 5)
+
+	feed(t, "\033[?25l\033[?1h\033=\033[?2004h")
+	want := MODE_HIDE | MODE_APPCURSOR | MODE_APPKEYPAD | MODE_BRCKTPASTE
+	if win.mode != want {
+		t.Errorf("window modes %#x, want %#x", win.mode, want)
+	}
+	feed(t, "\033[?25h\033[?1;2004l\033>")
+	if win.mode != 0 {
+		t.Errorf("window modes %#x after reset, want 0", win.mode)
+	}
+
+	feed(t, "\033[4h\033[20h\033[?7l")
+	if term.mode&(MODE_INSERT|MODE_CRLF|MODE_WRAP) != MODE_INSERT|MODE_CRLF {
+		t.Errorf("terminal modes %#x", term.mode)
+	}
+	feed(t, "\033[4l\033[20l\033[?7h")
+	if term.mode&(MODE_INSERT|MODE_CRLF|MODE_WRAP) != MODE_WRAP {
+		t.Errorf("terminal modes %#x after reset", term.mode)
+	}
+
+	feed(t, "\033[4 q")
+	if win.cursor != 4 {
+		t.Errorf("cursor style %d, want 4", win.cursor)
+	}
+	feed(t, "\033[4!q")
+	if win.cursor != 4 {
+		t.Errorf("cursor style changed by an unknown sequence")
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		col, row int
+	}{
+		{"shrink", fill, 6, 3},
+		{"grow", fill + "\033[2;3H", 14, 7},
+		{"cursor-top", fill + "\033[1;1H", 8, 2},
+		{"region", fill + "\033[2;4r\033[5;1H", 10, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testterm(t, 10, 5)
+			feed(t, tt.in)
+			tresize(tt.col, tt.row)
+			if term.top < 0 || term.bot >= term.row || term.top > term.bot {
+				t.Errorf("scroll region %d-%d outside of %d rows", term.top, term.bot, term.row)
+			}
+			feed(t, "!")
+			golden(t, "resize-"+tt.name, screen())
+		})
+	}
+}
+
+// tcheck verifies what the rest of st takes for granted about the terminal
+func tcheck(t *testing.T) {
+	t.Helper()
+	if len(term.line) != term.row || len(term.alt) != term.row || len(term.dirty) != term.row {
+		t.Fatalf("%d lines for %d rows", len(term.line), term.row)
+	}
+	for y := 0; y < term.row; y++ {
+		if len(term.line[y]) != term.col || len(term.alt[y]) != term.col {
+			t.Fatalf("line %d has %d cells for %d columns", y, len(term.line[y]), term.col)
+		}
+	}
+	if term.c.x < 0 || term.c.x >= term.col || term.c.y < 0 || term.c.y >= term.row {
+		t.Fatalf("cursor %d,%d outside of %dx%d", term.c.x, term.c.y, term.col, term.row)
+	}
+	if term.top < 0 || term.top > term.bot || term.bot >= term.row {
+		t.Fatalf("scroll region %d-%d outside of %d rows", term.top, term.bot, term.row)
+	}
+	if term.scr < 0 || term.scr > term.histn {
+		t.Fatalf("scrolled back %d lines of %d", term.scr, term.histn)
+	}
+	if sel.ob.x != -1 {
+		if sel.nb.y < term.scr-term.histn || sel.nb.y > sel.ne.y || sel.ne.y >= term.scr+term.row ||
+			sel.nb.x < 0 || sel.nb.x >= term.col || sel.ne.x < 0 || sel.ne.x >= term.col {
+			t.Fatalf("selection %v-%v outside of %dx%d and %d lines of history",
+				sel.nb, sel.ne, term.col, term.row, term.histn)
+		}
+		getsel()
+	}
+}
+
+// FuzzTwrite feeds arbitrary output to the terminal in reads of random
+// sizes, resizing it now and then, with a selection on the screen.
+func FuzzTwrite(f *testing.F) {
+	for _, tt := range screentests {
+		f.Add(uint8(10), uint8(5), uint64(0), []byte(tt.in))
+	}
+	for _, s := range []string{
+		"\033[38m\033[48;2m\033[38;5m\033[38:2m",
+		"\033[99999999999999999999;99999999999999999999H\033[99999999999999999999@",
+		"\033[?1049h\033[2;1r\033[5L\033[?6h\033[99M\033[?1049l",
+		"\033]52;c;?\a\033]4;999;red\a\033]4;-1;red\a\033]133;D;1\a\033]7;file:///tmp\a",
+		"\033_Ga=T,f=24,s=2,v=2;AAAAAAAAAAAAAAAA\033\\\033[5S\033[3T",
+		"\033]1337;File=inline=1;width=99:R0lGODlhAQABAAAAACw=\a",
+		"\xff\xfe\xc3\x28\xe2\x82\xc0\xaf",
+		"日本語\033[2@\033[1;10H日\033[1;9H\033[P",
+		"\xfe\x01\x01abc\xfe\x50\x50\033[99;99Hx",
+	} {
+		f.Add(uint8(12), uint8(4), uint64(len(s)), []byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, col, row uint8, reads uint64, data []byte) {
+		// don't bother the desktop
+		tokens, rate := notifytokens, notifyrate
+		notifytokens, notifyrate = 0, 0
+		t.Cleanup(func() { notifytokens, notifyrate = tokens, rate })
+
+		testterm(t, int(col%80)+1, int(row%40)+1)
+		selstart(0, 0, 0)
+		selextend(term.col-1, term.row-1, SEL_REGULAR, false)
+
+		var buf []byte
+		for len(data) > 0 {
+			// 0xfe and the two bytes after it resize the terminal
+			if data[0] == 0xfe && len(data) >= 3 {
+				tresize(int(data[1]%80)+1, int(data[2]%40)+1)
+				data = data[3:]
+				tcheck(t)
+				continue
+			}
+
+			// the read sizes come from reads as from a random generator
+			n := min(int(reads%64)+1, len(data))
+			reads = reads*6364136223846793005 + 1442695040888963407
+			if i := bytes.IndexByte(data[1:n], 0xfe); i >= 0 {
+				n = i + 1
+			}
+			buf = append(buf, data[:n]...)
+			data = data[n:]
+
+			buf = buf[twrite(buf, false):]
+			if len(buf) >= utf8.UTFMax {
+				t.Fatalf("twrite is stuck on %q", buf)
+			}
+			tcheck(t)
+		}
+	})
+}
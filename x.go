@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
@@ -15,6 +16,7 @@ import (
 	"github.com/qeedquan/go-media/x11/fc"
 	"github.com/qeedquan/go-media/x11/xft"
 	"github.com/qeedquan/go-media/x11/xlib"
+	"github.com/qeedquan/go-media/x11/xlib/xk"
 	"github.com/qeedquan/go-media/x11/xlib/xkb"
 	"github.com/qeedquan/go-media/x11/xlib/xrender"
 )
@@ -99,7 +101,7 @@ type TermWindow struct {
 }
 
 type XWindow struct {
-	dpy                                      *xlib.Display
+	dpy                                      *xlib.Display // nil when the core runs without a window
 	cmap                                     xlib.Colormap
 	win                                      xlib.Window
 	buf                                      xlib.Drawable
@@ -116,12 +118,20 @@ type XWindow struct {
 	gm                                       int
 	qev                                      []xlib.Event
 	mrpox, mrpoy                             int
+	title                                    string
+	status                                   int
+	overlay                                  []Line // drawn over the bottom rows
+	pastewait                                []byte // paste waiting for confirmation
 }
 
 type XSelection struct {
-	xtarget            xlib.Atom
-	primary, clipboard []byte
-	tclick1, tclick2   time.Time
+	xtarget                    xlib.Atom
+	primary, clipboard         []byte
+	primaryhtml, clipboardhtml []byte // the cells as HTML, nil unless copied from the screen
+	recv                       []byte // selection being received
+	recvincr                   bool   // received with INCR, until an empty chunk
+	tclick1, tclick2           time.Time
+	clicks                     int // in a row, for the snapping
 }
 
 type Font struct {
@@ -147,11 +157,16 @@ type DC struct {
 type Option struct {
 	class   string
 	cmd     []string
+	dir     string
 	embed   string
 	font    string
+	geom    string
 	io      string
 	line    string
 	name    string
+	play    string
+	record  string
+	render  string
 	title   string
 	version bool
 }
@@ -182,6 +197,8 @@ var handler = [xlib.LASTEvent]func(*xlib.Event){
 	// for the selection retrieval
 	xlib.PropertyNotify:   propnotify,
 	xlib.SelectionRequest: selrequest,
+	// of the requestors of INCR transfers
+	xlib.DestroyNotify: destroynotify,
 }
 
 var (
@@ -225,11 +242,18 @@ func clipcopy(interface{}) {
 	xsel.clipboard = nil
 	if xsel.primary != nil {
 		xsel.clipboard = append([]byte{}, xsel.primary...)
+		xsel.clipboardhtml = xsel.primaryhtml
 		clipboard := xlib.InternAtom(xw.dpy, "CLIPBOARD", false)
 		xlib.SetSelectionOwner(xw.dpy, clipboard, xw.win, xlib.CurrentTime)
 	}
 }
 
+func copycmdoutput(interface{}) {
+	if tselcmdoutput() {
+		setselcells(xlib.CurrentTime)
+	}
+}
+
 func clippaste(interface{}) {
 	clipboard := xlib.InternAtom(xw.dpy, "CLIPBOARD", false)
 	xlib.ConvertSelection(xw.dpy, clipboard, xsel.xtarget, clipboard,
@@ -290,7 +314,7 @@ func mousesel(ev *xlib.Event, done bool) {
 	}
 	selextend(evcol(ev), evrow(ev), seltype, done)
 	if done {
-		setsel(getsel(), e.Time())
+		setselcells(e.Time())
 	}
 }
 
@@ -390,13 +414,18 @@ func bpress(ev *xlib.Event) {
 		now := time.Now()
 		snap := 0
 		if now.Sub(xsel.tclick2) <= tripleclicktimeout {
-			snap = SNAP_LINE
+			snap = SNAP_PAIR
+			xsel.clicks++
 		} else if now.Sub(xsel.tclick1) <= doubleclicktimeout {
 			snap = SNAP_WORD
+			xsel.clicks = 2
+		} else {
+			xsel.clicks = 1
 		}
 		xsel.tclick2 = xsel.tclick1
 		xsel.tclick1 = now
 
+		sel.level = xsel.clicks - 2
 		selstart(evcol(ev), evrow(ev), snap)
 	}
 }
@@ -405,6 +434,13 @@ func propnotify(ev *xlib.Event) {
 	clipboard := xlib.InternAtom(xw.dpy, "CLIPBOARD", false)
 
 	xpev := ev.Property()
+	// st is the requestor too when pasting its own selection
+	if xpev.State() == xlib.PropertyDelete {
+		xincrsend(xpev.Window(), xpev.Atom())
+	}
+	if xpev.Window() != xw.win {
+		return
+	}
 	if xpev.State() == xlib.PropertyNewValue && (xpev.Atom() == xlib.XA_PRIMARY || xpev.Atom() == clipboard) {
 		selnotify(ev)
 	}
@@ -418,6 +454,7 @@ func selnotify(ev *xlib.Event) {
 	case xlib.SelectionNotify:
 		e := ev.Selection()
 		property = e.Property()
+		xsel.recv = xsel.recv[:0]
 	case xlib.PropertyNotify:
 		e := ev.Property()
 		property = e.Atom()
@@ -442,6 +479,7 @@ func selnotify(ev *xlib.Event) {
 			// PropertyNotify events anymore.
 			xw.attrs.SetEventMask(xw.attrs.EventMask() &^ xlib.PropertyChangeMask)
 			xlib.ChangeWindowAttributes(xw.dpy, xw.win, xlib.CWEventMask, &xw.attrs)
+			xsel.recvincr = false
 		}
 
 		if typ == incratom {
@@ -450,30 +488,14 @@ func selnotify(ev *xlib.Event) {
 			// chunk of data.
 			xw.attrs.SetEventMask(xw.attrs.EventMask() | xlib.PropertyChangeMask)
 			xlib.ChangeWindowAttributes(xw.dpy, xw.win, xlib.CWEventMask, &xw.attrs)
+			xsel.recvincr = true
 
 			// Deleting the property is the transfer start signal.
 			xlib.DeleteProperty(xw.dpy, xw.win, property)
 			continue
 		}
 
-		// As seen in getsel:
-		// Line endings are inconsistent in the terminal and GUI world
-		// copy and pasting. When receiving some selection data,
-		// replace all '\n' with '\r'.
-		// FIXME: Fix the computer world.
-		for repl := 0; repl < nitems*format/8; repl++ {
-			if data[repl] == '\n' {
-				data[repl] = '\r'
-			}
-		}
-
-		if win.mode&MODE_BRCKTPASTE != 0 && ofs == 0 {
-			ttywrite([]byte("\033[200~"), false)
-		}
-		ttywrite(data[:nitems*format/8], true)
-		if win.mode&MODE_BRCKTPASTE != 0 && rem == 0 {
-			ttywrite([]byte("\033[201~"), false)
-		}
+		xsel.recv = append(xsel.recv, data[:nitems*format/8]...)
 
 		// number of 32-bit chunks returned
 		ofs += nitems * format / 32
@@ -486,6 +508,73 @@ func selnotify(ev *xlib.Event) {
 	// Deleting the property again tells the selection owner to send the
 	// next data chunk in the property.
 	xlib.DeleteProperty(xw.dpy, xw.win, property)
+
+	// the whole paste is needed to filter and confirm it
+	if !xsel.recvincr {
+		xpaste(xsel.recv)
+		xsel.recv = nil
+	}
+}
+
+// xpaste writes a paste to the tty, once the user agreed to it if it
+// has several lines that would run at once
+func xpaste(data []byte) {
+	// As seen in getsel:
+	// Line endings are inconsistent in the terminal and GUI world
+	// copy and pasting. When receiving some selection data,
+	// replace all '\n' with '\r'.
+	// FIXME: Fix the computer world.
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r"))
+	data = tfilterpaste(data, win.mode&MODE_BRCKTPASTE != 0)
+	if len(data) == 0 {
+		return
+	}
+
+	if pasteconfirm && win.mode&MODE_BRCKTPASTE == 0 && bytes.IndexByte(data, '\r') >= 0 {
+		xw.pastewait = data
+		xpasteoverlay()
+		return
+	}
+	xpastewrite(data)
+}
+
+func xpastewrite(data []byte) {
+	if win.mode&MODE_BRCKTPASTE != 0 {
+		ttywrite([]byte("\033[200~"), false)
+	}
+	ttywrite(data, true)
+	if win.mode&MODE_BRCKTPASTE != 0 {
+		ttywrite([]byte("\033[201~"), false)
+	}
+}
+
+// xpasteoverlay shows the first lines of the paste waiting for
+// confirmation
+func xpasteoverlay() {
+	lines := bytes.Split(bytes.TrimSuffix(xw.pastewait, []byte("\r")), []byte("\r"))
+	bar := Glyph{fg: defaultfg, bg: defaultbg, mode: ATTR_REVERSE}
+	text := Glyph{fg: defaultfg, bg: defaultbg}
+
+	overlay := []Line{tstrline(fmt.Sprintf(" Paste %d lines? [y/N]", len(lines)), bar)}
+	for i, l := range lines {
+		if i == 3 {
+			overlay = append(overlay, tstrline(" ...", text))
+			break
+		}
+		l = bytes.ReplaceAll(l, []byte("\t"), []byte(" "))
+		overlay = append(overlay, tstrline(" "+string(l), text))
+	}
+	xsetoverlay(overlay)
+}
+
+// xpasteconfirm handles a key while a paste waits for confirmation
+func xpasteconfirm(str []byte) {
+	// a reflexive Enter is the very thing to stop
+	if len(str) == 1 && (str[0] == 'y' || str[0] == 'Y') {
+		xpastewrite(xw.pastewait)
+	}
+	xw.pastewait = nil
+	xsetoverlay(nil)
 }
 
 func xclipcopy() {
@@ -512,39 +601,196 @@ func selrequest(ev *xlib.Event) {
 	// reject
 	xev.SetProperty(xlib.None)
 
+	var seltext, selhtml []byte
+	clipboard := xlib.InternAtom(xw.dpy, "CLIPBOARD", false)
+	if xsre.Selection() == xlib.XA_PRIMARY {
+		seltext, selhtml = xsel.primary, xsel.primaryhtml
+	} else if xsre.Selection() == clipboard {
+		seltext, selhtml = xsel.clipboard, xsel.clipboardhtml
+	} else {
+		fmt.Fprintf(os.Stderr, "Unhandled clipboard selection 0x%x\n", xsre.Selection())
+		return
+	}
+
 	xa_targets := xlib.InternAtom(xw.dpy, "TARGETS", false)
-	if xsre.Target() == xa_targets {
-		// respond with the supported type
-		string_ := xsel.xtarget
+	xa_text := xlib.InternAtom(xw.dpy, "TEXT", false)
+	xa_ctext := xlib.InternAtom(xw.dpy, "COMPOUND_TEXT", false)
+	xa_plain := xlib.InternAtom(xw.dpy, "text/plain;charset=utf-8", false)
+	xa_html := xlib.InternAtom(xw.dpy, "text/html", false)
+
+	typ, data := xsre.Target(), []byte(nil)
+	switch target := xsre.Target(); {
+	case target == xa_targets:
+		// respond with the supported types
+		targets := []xlib.Atom{xa_targets, xsel.xtarget, xa_plain, xlib.XA_STRING, xa_text, xa_ctext}
+		if selhtml != nil {
+			targets = append(targets, xa_html)
+		}
 		xlib.ChangeProperty(xsre.Display(), xsre.Requestor(), xsre.Property(),
-			xlib.XA_ATOM, 32, xlib.PropModeReplace, string_)
+			xlib.XA_ATOM, 32, xlib.PropModeReplace, targets)
 		xev.SetProperty(xsre.Property())
-	} else if xsre.Target() == xsel.xtarget || xsre.Target() == xlib.XA_STRING {
+	case target == xsel.xtarget || target == xa_plain || target == xlib.XA_STRING:
 		// xith XA_STRING non ascii characters may be incorrect in the
 		// requestor. It is not our problem, use utf8.
-		var seltext []byte
-		clipboard := xlib.InternAtom(xw.dpy, "CLIPBOARD", false)
-		if xsre.Selection() == xlib.XA_PRIMARY {
-			seltext = xsel.primary
-		} else if xsre.Selection() == clipboard {
-			seltext = xsel.clipboard
+		data = seltext
+	case target == xa_text:
+		// the owner chooses the encoding, old clients read STRING
+		if data = latin1(seltext); data != nil {
+			typ = xlib.XA_STRING
 		} else {
-			fmt.Fprintf(os.Stderr, "Unhandled clipboard selection 0x%lx\n", xsre.Selection())
-			return
+			typ, data = xa_ctext, compoundtext(seltext)
 		}
+	case target == xa_ctext:
+		data = compoundtext(seltext)
+	case target == xa_html:
+		data = selhtml
+	}
 
-		if seltext != nil {
-			xlib.ChangeProperty(xsre.Display(), xsre.Requestor(),
-				xsre.Property(), xsre.Target(),
-				8, xlib.PropModeReplace, seltext)
-			xev.SetProperty(xsre.Property())
-		}
+	if data != nil && len(data) > xincrsize() {
+		xincrstart(xsre.Requestor(), xsre.Property(), typ, data)
+		xev.SetProperty(xsre.Property())
+	} else if data != nil {
+		xlib.ChangeProperty(xsre.Display(), xsre.Requestor(),
+			xsre.Property(), typ,
+			8, xlib.PropModeReplace, data)
+		xev.SetProperty(xsre.Property())
 	}
 
 	// all done, send a notification to the listener
 	err := xlib.SendEvent(xsre.Display(), xsre.Requestor(), true, 0, xev.Cast())
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error sending SelectionNotify event: %v", err)
+		fmt.Fprintf(os.Stderr, "Error sending SelectionNotify event: %v\n", err)
+	}
+}
+
+// xincrsize returns the largest chunk of a selection sent at once,
+// which must fit in a request of the server
+func xincrsize() int {
+	n := xlib.ExtendedMaxRequestSize(xw.dpy)
+	if n == 0 {
+		n = xlib.MaxRequestSize(xw.dpy)
+	}
+	// in 4 bytes units, keep room for the request header
+	return min(n*4-100, 256*1024)
+}
+
+// xincrstart announces an INCR transfer to the requestor, the data is
+// sent once it deletes the property
+func xincrstart(w xlib.Window, property, typ xlib.Atom, data []byte) {
+	incrstart(w, property, typ, data)
+	xincrwatch(w, true)
+
+	incratom := xlib.InternAtom(xw.dpy, "INCR", false)
+	xlib.ChangeProperty(xw.dpy, w, property, incratom, 32, xlib.PropModeReplace, []int{len(data)})
+}
+
+// xincrsend sends the next chunk of the transfer to w, an empty chunk
+// ends it
+func xincrsend(w xlib.Window, property xlib.Atom) {
+	chunk, t := incrnext(w, property, xincrsize())
+	if t == nil {
+		return
+	}
+	xlib.ChangeProperty(xw.dpy, w, property, t.typ, 8, xlib.PropModeReplace, chunk)
+	if len(chunk) == 0 && !incrbusy(w) {
+		xincrwatch(w, false)
+	}
+}
+
+// xincrwatch selects the events of the requestor w st needs for the
+// transfers: its properties being deleted, and it being destroyed
+func xincrwatch(w xlib.Window, on bool) {
+	if w == xw.win {
+		// its own window has other events selected, and the
+		// receiving side of the paste needs the property changes
+		// until it is done
+		if !on && xsel.recvincr {
+			return
+		}
+		mask := xw.attrs.EventMask() &^ xlib.PropertyChangeMask
+		if on {
+			mask |= xlib.PropertyChangeMask
+		}
+		xw.attrs.SetEventMask(mask)
+		xlib.ChangeWindowAttributes(xw.dpy, xw.win, xlib.CWEventMask, &xw.attrs)
+		return
+	}
+	if on {
+		xlib.SelectInput(xw.dpy, w, xlib.PropertyChangeMask|xlib.StructureNotifyMask)
+	} else {
+		xlib.SelectInput(xw.dpy, w, xlib.NoEventMask)
+	}
+}
+
+// xincrgc drops the transfers whose requestor stopped reading, called
+// from the main loop. The requestors destroyed were already dropped by
+// destroynotify, the others are still there to be left alone.
+func xincrgc() {
+	if len(incrs) == 0 {
+		return
+	}
+	for _, w := range incrgc() {
+		xincrwatch(w, false)
+	}
+}
+
+func destroynotify(ev *xlib.Event) {
+	if w := ev.DestroyWindow().Window(); w != xw.win {
+		incrdrop(w)
+	}
+}
+
+// latin1 converts utf8 to ISO 8859-1, nil if some chars are not in it
+func latin1(s []byte) []byte {
+	if s == nil {
+		return nil
+	}
+	b := make([]byte, 0, len(s))
+	for _, r := range string(s) {
+		if r > 0xff {
+			return nil
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+// compoundtext converts utf8 to the compound text encoding, which is
+// ISO 8859-1 by default and switches to utf8 for the other chars as
+// Xutf8TextListToTextProperty does.
+func compoundtext(s []byte) []byte {
+	if s == nil {
+		return nil
+	}
+	var b []byte
+	inutf8 := false
+	for _, r := range string(s) {
+		if r == '\t' || r == '\n' || (0x20 <= r && r < 0x7f) || (0xa0 <= r && r <= 0xff) {
+			if inutf8 {
+				b = append(b, "\033%@"...)
+				inutf8 = false
+			}
+			b = append(b, byte(r))
+			continue
+		}
+		if !inutf8 {
+			b = append(b, "\033%G"...)
+			inutf8 = true
+		}
+		b = utf8.AppendRune(b, r)
+	}
+	if inutf8 {
+		b = append(b, "\033%@"...)
+	}
+	return b
+}
+
+// setselcells sets the primary selection to the selected cells, as text
+// and as HTML with their colors
+func setselcells(t xlib.Time) {
+	setsel(getsel(), t)
+	if xsel.primary != nil {
+		xsel.primaryhtml = getselhtml()
 	}
 }
 
@@ -554,6 +800,10 @@ func setsel(str []byte, t xlib.Time) {
 	}
 
 	xsel.primary = str
+	xsel.primaryhtml = nil
+	if xw.dpy == nil {
+		return
+	}
 	xlib.SetSelectionOwner(xw.dpy, xlib.XA_PRIMARY, xw.win, t)
 	if xlib.GetSelectionOwner(xw.dpy, xlib.XA_PRIMARY) != xw.win {
 		selclear()
@@ -564,6 +814,23 @@ func xsetsel(str []byte) {
 	setsel(str, xlib.CurrentTime)
 }
 
+func xsetclipboard(str []byte) {
+	xsel.clipboard = str
+	xsel.clipboardhtml = nil
+	if xw.dpy == nil {
+		return
+	}
+	clipboard := xlib.InternAtom(xw.dpy, "CLIPBOARD", false)
+	xlib.SetSelectionOwner(xw.dpy, clipboard, xw.win, xlib.CurrentTime)
+}
+
+func xgetsel(clipboard bool) []byte {
+	if clipboard {
+		return xsel.clipboard
+	}
+	return xsel.primary
+}
+
 func brelease(ev *xlib.Event) {
 	e := ev.Button()
 	if win.mode&MODE_MOUSE != 0 && e.State()&forceselmod == 0 {
@@ -605,6 +872,19 @@ func cresize(width, height int) {
 	tresize(col, row)
 	xresize(col, row)
 	ttyresize(win.tw, win.th)
+	recresize(col, row)
+}
+
+// xsetsize resizes the window to hold col x row cells
+func xsetsize(col, row int) {
+	if col == term.col && row == term.row {
+		return
+	}
+	w := 2*borderpx + col*win.cw
+	h := 2*borderpx + row*win.ch
+	xlib.ResizeWindow(xw.dpy, xw.win, w, h)
+	cresize(w, h)
+	xhints()
 }
 
 func xresize(col, row int) {
@@ -657,6 +937,9 @@ func xloadcolor(i int, name string, ncolor *Color) bool {
 }
 
 func xloadcols() {
+	if xw.dpy == nil {
+		return
+	}
 	for i := range dc.col {
 		xft.ColorFree(xw.dpy, xw.vis, xw.cmap, &dc.col[i])
 	}
@@ -676,7 +959,7 @@ func xloadcols() {
 func xsetcolorname(x int, name string) bool {
 	var ncolor Color
 
-	if !(0 <= x && x <= len(dc.col)) {
+	if !(0 <= x && x < len(dc.col)) || xw.dpy == nil {
 		return true
 	}
 
@@ -947,12 +1230,52 @@ func ximdestroy(xim xlib.IM, call xlib.Pointer) {
 		"ximinstantiate", ximinstantiate)
 }
 
-func xinit(cols, rows int) {
+// xresources returns the resource database xrdb keeps on the root window
+func xresources() string {
+	rm := xlib.InternAtom(xw.dpy, "RESOURCE_MANAGER", true)
+	if rm == xlib.None {
+		return ""
+	}
+	root := xlib.RootWindow(xw.dpy, xw.scr)
+
+	var db []byte
+	ofs := 0
+	for {
+		_, format, nitems, rem, data, err := xlib.GetWindowProperty(xw.dpy, root, rm, ofs, 8192/4, false, xlib.AnyPropertyType)
+		if err != nil || format != 8 {
+			break
+		}
+		db = append(db, data[:nitems]...)
+		ofs += nitems * format / 32
+		if rem <= 0 {
+			break
+		}
+	}
+	return string(db)
+}
+
+// xopen opens the display and applies the X resources, before the
+// terminal is made as they set its size and history
+func xopen() {
 	xw.dpy = xlib.OpenDisplay("")
 	if xw.dpy == nil {
 		log.Fatal("can't open display")
 	}
 	xw.scr = xlib.DefaultScreen(xw.dpy)
+
+	resname, resclass := opt.name, opt.class
+	if resname == "" {
+		resname = "st"
+	}
+	if resclass == "" {
+		resclass = "St"
+	}
+	for _, err := range xrmload(xresources(), resname, resclass) {
+		fmt.Fprintf(os.Stderr, "xresources: %v\n", err)
+	}
+}
+
+func xinit(cols, rows int) {
 	xw.vis = xlib.DefaultVisual(xw.dpy, xw.scr)
 
 	// font
@@ -1048,6 +1371,7 @@ func xinit(cols, rows int) {
 		xlib.PropModeReplace, thispid)
 
 	win.mode = MODE_NUMLOCK
+	xw.status = -1
 	resettitle()
 	xlib.MapWindow(xw.dpy, xw.win)
 	xhints()
@@ -1223,7 +1547,7 @@ func xdrawglyphfontspecs(specs []xft.GlyphFontSpec, base Glyph, len_, x, y int)
 		colbg.SetRed(uint16(truered(base.bg)))
 		colbg.SetGreen(uint16(truegreen(base.bg)))
 		colbg.SetBlue(uint16(trueblue(base.bg)))
-		xft.ColorAllocValue(xw.dpy, xw.vis, xw.cmap, &colfg, &truebg)
+		xft.ColorAllocValue(xw.dpy, xw.vis, xw.cmap, &colbg, &truebg)
 		bg = &truebg
 	} else {
 		bg = &dc.col[base.bg]
@@ -1270,6 +1594,13 @@ func xdrawglyphfontspecs(specs []xft.GlyphFontSpec, base Glyph, len_, x, y int)
 		fg = &revfg
 	}
 
+	if base.mode&ATTR_HIGHLIGHT != 0 {
+		fg, bg = &dc.col[searchfg], &dc.col[searchbg]
+		if base.mode&ATTR_HIGHLIGHT_CUR != 0 {
+			bg = &dc.col[searchcurbg]
+		}
+	}
+
 	if base.mode&ATTR_REVERSE != 0 {
 		fg, bg = bg, fg
 	}
@@ -1345,6 +1676,77 @@ func xdrawglyph(g Glyph, x, y int) {
 	glyph := []Glyph{g}
 	numspecs := xmakeglyphfontspecs(spec, glyph, 1, x, y)
 	xdrawglyphfontspecs(spec, g, numspecs, x, y)
+	xdrawimages(glyph, x, y)
+}
+
+func xgetcellsize() (int, int) {
+	return win.cw, win.ch
+}
+
+// xdrawimg draws n cells of the placement shown in base at the cell x, y
+func xdrawimg(base Glyph, n, x, y int) {
+	p := placements[base.img]
+	if p == nil {
+		return
+	}
+	pix := imgscaled(p, win.cw, win.ch)
+
+	// The image is composed over the background and converted to
+	// the 32 bits BGRX layout of the true color visuals.
+	col := defaultbg
+	if win.mode&MODE_REVERSE != 0 {
+		col = defaultfg
+	}
+	bg := dc.col[col].Color()
+	bgr, bgg, bgb := uint32(bg.Red()>>8), uint32(bg.Green()>>8), uint32(bg.Blue()>>8)
+
+	sx := int(base.imgx) * win.cw
+	sy := int(base.imgy) * win.ch
+	w, h := n*win.cw, win.ch
+	data := make([]byte, w*h*4)
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			c := pix.RGBAAt(sx+i, sy+j)
+			a := 255 - uint32(c.A)
+			d := data[(j*w+i)*4:]
+			d[0] = byte(uint32(c.B) + bgb*a/255)
+			d[1] = byte(uint32(c.G) + bgg*a/255)
+			d[2] = byte(uint32(c.R) + bgr*a/255)
+			d[3] = 0xff
+		}
+	}
+
+	ximg := xlib.CreateImage(xw.dpy, xw.vis, xlib.DefaultDepth(xw.dpy, xw.scr), xlib.ZPixmap, 0, data, w, h, 32, 0)
+	if ximg == nil {
+		return
+	}
+	xlib.PutImage(xw.dpy, xw.buf, dc.gc, ximg, 0, 0, borderpx+x*win.cw, borderpx+y*win.ch, w, h)
+	xlib.DestroyImage(ximg)
+}
+
+// xdrawimages draws the images shown in the glyphs of a line starting at
+// the cell x, y, images below the text only show in the blank cells.
+func xdrawimages(line []Glyph, x, y int) {
+	for i := 0; i < len(line); {
+		base := line[i]
+		n := 1
+		if base.img != 0 {
+			for i+n < len(line) && line[i+n].img == base.img &&
+				line[i+n].imgy == base.imgy && int(line[i+n].imgx) == int(base.imgx)+n {
+				n++
+			}
+			if p := placements[base.img]; p != nil && p.z < 0 {
+				n = 1
+				if base.u != ' ' {
+					base.img = 0
+				}
+			}
+			if base.img != 0 {
+				xdrawimg(base, n, x+i, y)
+			}
+		}
+		i += n
+	}
 }
 
 func xdrawcursor(cx, cy int, g Glyph, ox, oy int, og Glyph) {
@@ -1354,6 +1756,15 @@ func xdrawcursor(cx, cy int, g Glyph, ox, oy int, og Glyph) {
 	}
 	xdrawglyph(og, ox, oy)
 
+	// copy mode, shown even when the application hides the cursor
+	if copymode.active {
+		g.mode &= ATTR_BOLD | ATTR_ITALIC | ATTR_UNDERLINE | ATTR_STRUCK | ATTR_WIDE
+		g.fg = defaultbg
+		g.bg = copymodecs
+		xdrawglyph(g, cx, cy)
+		return
+	}
+
 	if win.mode&MODE_HIDE != 0 {
 		return
 	}
@@ -1505,12 +1916,38 @@ func kpress(ev *xlib.Event) {
 
 	e := ev.Key()
 	str, ksym, _ := xlib.XmbLookupString(xw.xic, (*xlib.KeyPressedEvent)(e))
-	// 1. shortcuts
-	for _, bp := range shortcuts {
-		if ksym == bp.keysym && match(bp.mod, e.State()) {
-			bp.funct(bp.arg)
-			return
+	if xw.pastewait != nil {
+		if len(str) > 0 {
+			xpasteconfirm([]byte(str))
 		}
+		return
+	}
+
+	// 1. shortcuts, the replay controls first when replaying
+	tables := [][]Shortcut{shortcuts}
+	if player != nil {
+		tables = [][]Shortcut{playshortcuts, shortcuts}
+	}
+	for _, t := range tables {
+		for _, bp := range t {
+			if ksym == bp.keysym && match(bp.mod, e.State()) {
+				bp.funct(bp.arg)
+				return
+			}
+		}
+	}
+
+	if hints.active {
+		hintkey(str)
+		return
+	}
+	if search.active {
+		xsearchkey(ksym, str)
+		return
+	}
+	if copymode.active {
+		xcopymodekey(ksym, str)
+		return
 	}
 
 	// 2. custom keys from config.h
@@ -1546,6 +1983,48 @@ func kpress(ev *xlib.Event) {
 	ttywrite(buf, true)
 }
 
+// xcopymodekey passes a key to copy mode, the arrows move like hjkl and
+// y copies the selection to the primary selection and the clipboard
+func xcopymodekey(ksym xlib.KeySym, str string) {
+	switch ksym {
+	case xk.Left:
+		str = "h"
+	case xk.Down:
+		str = "j"
+	case xk.Up:
+		str = "k"
+	case xk.Right:
+		str = "l"
+	}
+	if str != "y" {
+		copymodekey(str)
+		return
+	}
+	if sel.ob.x != -1 {
+		setselcells(xlib.CurrentTime)
+		clipcopy(nil)
+	}
+	copymodeleave()
+}
+
+// xsearchkey passes a key to the search prompt, up and down step
+// through the matches and return selects the current one
+func xsearchkey(ksym xlib.KeySym, str string) {
+	switch ksym {
+	case xk.Down:
+		str = "\016"
+	case xk.Up:
+		str = "\020"
+	}
+	if str != "\r" {
+		searchkey(str)
+		return
+	}
+	if searchselect() {
+		setselcells(xlib.CurrentTime)
+	}
+}
+
 func xsetenv() {
 	os.Setenv("WINDOWID", fmt.Sprintf("%d", xw.win))
 }
@@ -1555,17 +2034,40 @@ func xsettitle(p []byte) {
 	if p == nil {
 		p = []byte(opt.title)
 	}
-	xlib.UTF8TextListToTextProperty(xw.dpy, []string{string(p)}, xlib.UTF8StringStyle, &prop)
+	xw.title = string(p)
+	if xw.dpy == nil {
+		return
+	}
+
+	title := xw.title
+	if titlestatus && xw.status >= 0 {
+		title = fmt.Sprintf("%s [%d]", title, xw.status)
+	}
+	xlib.UTF8TextListToTextProperty(xw.dpy, []string{title}, xlib.UTF8StringStyle, &prop)
 	xlib.SetWMName(xw.dpy, xw.win, &prop)
 	xlib.SetTextProperty(xw.dpy, xw.win, &prop, xw.netwmname)
 	prop.Free()
 }
 
+// xsetstatus updates the exit status of the last command shown in the title
+func xsetstatus(status int) {
+	xw.status = status
+	if titlestatus {
+		xsettitle([]byte(xw.title))
+	}
+}
+
 func xstartdraw() bool {
 	return win.mode&MODE_VISIBLE != 0
 }
 
 func xdrawline(line Line, x1, y1, x2 int) {
+	xdrawcells(line, x1, y1, x2, true)
+}
+
+// xdrawcells draws the cells x1 to x2 of a line at the row y1, showing
+// the selection unless it is an overlay
+func xdrawcells(line Line, x1, y1, x2 int, showsel bool) {
 	specs := xw.specbuf
 
 	numspecs := xmakeglyphfontspecs(specs, line[x1:], x2-x1, x1, y1)
@@ -1577,9 +2079,12 @@ func xdrawline(line Line, x1, y1, x2 int) {
 		if new_.mode&ATTR_WDUMMY != 0 {
 			continue
 		}
-		if selected(x, y1) {
+		if showsel && selected(x, y1) {
 			new_.mode ^= ATTR_REVERSE
 		}
+		if showsel {
+			new_.mode |= searchattr(x, y1)
+		}
 		if i > 0 && gattrcmp(&base, &new_) {
 			xdrawglyphfontspecs(specs, base, i, ox, y1)
 			specs = specs[i:]
@@ -1595,9 +2100,22 @@ func xdrawline(line Line, x1, y1, x2 int) {
 	if i > 0 {
 		xdrawglyphfontspecs(specs, base, i, ox, y1)
 	}
+	xdrawimages(line[x1:x2], x1, y1)
+}
+
+// xsetoverlay sets the lines shown over the bottom of the screen, nil
+// to remove them
+func xsetoverlay(lines []Line) {
+	xw.overlay = lines
+	tfulldirt()
 }
 
 func xfinishdraw() {
+	for i, line := range xw.overlay {
+		if y := term.row - len(xw.overlay) + i; y >= 0 {
+			xdrawcells(line, 0, y, min(term.col, len(line)), false)
+		}
+	}
 	xlib.CopyArea(xw.dpy, xw.buf, xlib.Drawable(xw.win), dc.gc, 0, 0, win.w, win.h, 0, 0)
 	col := defaultfg
 	if win.mode&MODE_REVERSE != 0 {
@@ -1631,11 +2149,18 @@ func visibility(ev *xlib.Event) {
 	}
 }
 
-func unmap(*xlib.Event) {
+func unmap(ev *xlib.Event) {
+	// the requestors of INCR transfers send theirs too
+	if ev.Unmap().Window() != xw.win {
+		return
+	}
 	win.mode &^= MODE_VISIBLE
 }
 
 func xsetpointermotion(set bool) {
+	if xw.dpy == nil {
+		return
+	}
 	mask := xw.attrs.EventMask() &^ xlib.PointerMotionMask
 	if set {
 		mask |= xlib.PointerMotionMask
@@ -1656,6 +2181,9 @@ func xsetmode(set bool, flags int) {
 }
 
 func xseturgency(add bool) {
+	if xw.dpy == nil {
+		return
+	}
 	h := xlib.GetWMHints(xw.dpy, xw.win)
 	f := h.Flags() &^ xlib.UrgencyHint
 	if add {
@@ -1667,6 +2195,9 @@ func xseturgency(add bool) {
 }
 
 func xbell() {
+	if xw.dpy == nil {
+		return
+	}
 	if win.mode&MODE_FOCUSED == 0 {
 		xseturgency(true)
 	}
@@ -1716,7 +2247,7 @@ func cmessage(ev *xlib.Event) {
 
 func resize(ev *xlib.Event) {
 	e := ev.Configure()
-	if e.Width() == win.w && e.Height() == win.h {
+	if e.Window() != xw.win || e.Width() == win.w && e.Height() == win.h {
 		return
 	}
 	cresize(e.Width(), e.Height())
@@ -1756,8 +2287,18 @@ loop:
 			break loop
 		}
 	}
-	ttynew(opt.line, shell, opt.io, opt.cmd)
-	cresize(w, h)
+	if opt.play != "" {
+		cresize(w, h)
+		playstart()
+	} else {
+		ttynew(opt.line, shell, opt.dir, opt.io, opt.cmd)
+		cresize(w, h)
+	}
+	if opt.record != "" {
+		if err := recopen(opt.record, term.col, term.row); err != nil {
+			fmt.Fprintf(os.Stderr, "record: %v\n", err)
+		}
+	}
 
 	blinkset := false
 	last := time.Now()
@@ -1765,20 +2306,33 @@ loop:
 
 	tv := time.NewTimer(1 * time.Second)
 	xev := actionfps
-	go trun()
+	if opt.play == "" {
+		go trun()
+	}
 	for {
 		var fds int
 		select {
 		case <-term.rdy:
 			fds = 1
+		case b := <-piperead:
+			// filtered and confirmed as any paste
+			xpaste(b)
+		case <-notifyfailed:
+			notifyurgent()
 		case <-tv.C:
 		}
 
 		xrun()
+		xincrgc()
+		if opt.play != "" && playrun() {
+			fds = 1
+		}
 		switch fds {
 		case 1:
-			ttyread()
-			term.rdy <- struct{}{}
+			if opt.play == "" {
+				ttyread()
+				term.rdy <- struct{}{}
+			}
 			if blinktimeout != 0 {
 				blinkset = tattrset(ATTR_BLINK)
 				if !blinkset {
@@ -1845,13 +2399,20 @@ func usage() {
 func main() {
 	log.SetPrefix("")
 	log.SetFlags(0)
+	// before the flags, they have the last word
+	confload()
 	xw.l, xw.t = 0, 0
 	xw.isfixed = false
-	win.cursor = cursorshape
 	flag.BoolVar(&allowaltscreen, "a", !allowaltscreen, "disable alt screen")
+	flag.StringVar(&opt.class, "c", opt.class, "set class")
+	flag.StringVar(&opt.dir, "d", opt.dir, "set working directory")
+	flag.StringVar(&opt.geom, "geometry", opt.geom, "set the size in cells, as COLSxROWS")
 	flag.BoolVar(&xw.isfixed, "i", xw.isfixed, "fixed screen")
 	flag.StringVar(&opt.line, "l", opt.line, "set line")
 	flag.StringVar(&opt.name, "n", opt.name, "set name")
+	flag.StringVar(&opt.play, "P", opt.play, "replay an asciicast or ttyrec file instead of running a shell")
+	flag.StringVar(&opt.record, "R", opt.record, "record the session to an asciicast file")
+	flag.StringVar(&opt.render, "render", opt.render, "render the standard input to a PNG file, without X")
 	flag.StringVar(&opt.title, "t", opt.title, "set title")
 	flag.StringVar(&opt.embed, "w", opt.embed, "set embed")
 	flag.BoolVar(&opt.version, "v", opt.version, "show version")
@@ -1860,6 +2421,11 @@ func main() {
 	if opt.version {
 		log.Fatal(VERSION)
 	}
+	if opt.play != "" {
+		if err := playopen(opt.play); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	if opt.title == "" {
 		if opt.line != "" || len(opt.cmd) == 0 {
@@ -1869,11 +2435,33 @@ func main() {
 		}
 	}
 	opt.cmd = flag.Args()
-	err := xlib.InitThreads()
-	if err != nil {
-		log.Fatal(err)
+	if opt.render == "" {
+		if err := xlib.InitThreads(); err != nil {
+			log.Fatal(err)
+		}
+		xlib.SetLocaleModifiers("")
+
+		// the flags have the last word over the X resources too
+		set := map[string]string{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+		xopen()
+		for name, v := range set {
+			flag.Set(name, v)
+		}
+	}
+	win.cursor = cursorshape
+	if opt.geom != "" {
+		if n, _ := fmt.Sscanf(opt.geom, "%dx%d", &cols, &rows); n != 2 {
+			usage()
+		}
+	}
+	if opt.render != "" {
+		tnew(max(cols, 1), max(rows, 1))
+		if err := renderpng(opt.render, os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	xlib.SetLocaleModifiers("")
 	cols = max(cols, 1)
 	rows = max(rows, 1)
 	tnew(cols, rows)
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// X resources, as loaded by xrdb, override config.go and the config file.
+// The settings have the names of the config file, as st.font, st.color0
+// or St*borderpx, with foreground, background, cursorColor and
+// reverseCursor for the default colors. The durations can be given in
+// milliseconds.
+
+type XrmEntry struct {
+	comps []string // the components of the name
+	loose []bool   // bound by * rather than . to the previous one
+	value string
+}
+
+// xrmparse reads the lines of a resource database
+func xrmparse(db string) []XrmEntry {
+	var entries []XrmEntry
+	db = strings.ReplaceAll(db, "\\\n", "")
+	for _, l := range strings.Split(db, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '!' || l[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(l, ':')
+		if i < 0 {
+			continue
+		}
+
+		var e XrmEntry
+		loose := false
+		spec := strings.TrimSpace(l[:i])
+		for len(spec) > 0 {
+			switch spec[0] {
+			case '*':
+				loose = true
+				spec = spec[1:]
+				continue
+			case '.':
+				spec = spec[1:]
+				continue
+			}
+			n := strings.IndexAny(spec, ".*")
+			if n < 0 {
+				n = len(spec)
+			}
+			e.comps = append(e.comps, spec[:n])
+			e.loose = append(e.loose, loose)
+			spec, loose = spec[n:], false
+		}
+		e.value = xrmunescape(strings.TrimSpace(l[i+1:]))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// xrmunescape turns \n, \\ and \ooo into the chars they stand for
+func xrmunescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = s[i]; {
+		case c == 'n':
+			b.WriteByte('\n')
+		case '0' <= c && c <= '7' && i+2 < len(s):
+			if n, err := strconv.ParseUint(s[i:i+3], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				break
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// xrmget returns the value of resource res of the program, the most
+// specific entry wins: the name over the class over ?, and a tight
+// binding over a loose one
+func xrmget(entries []XrmEntry, name, class, res string) (string, bool) {
+	best, found := -1, ""
+	for _, e := range entries {
+		n := len(e.comps)
+		if n == 0 || n > 2 || e.comps[n-1] != res {
+			continue
+		}
+
+		score := 0
+		if n == 1 {
+			// the program skipped by *
+			if !e.loose[0] {
+				continue
+			}
+		} else {
+			switch e.comps[0] {
+			case name:
+				score = 6
+			case class:
+				score = 4
+			case "?":
+				score = 2
+			default:
+				continue
+			}
+			if !e.loose[1] {
+				score++
+			}
+		}
+		if score >= best {
+			best, found = score, e.value
+		}
+	}
+	return found, best >= 0
+}
+
+// xrmload applies the resources of db and returns the errors in their
+// values
+func xrmload(db, name, class string) []error {
+	entries := xrmparse(db)
+	if len(entries) == 0 {
+		return nil
+	}
+	var errs []error
+	get := func(res string) (string, bool) {
+		return xrmget(entries, name, class, res)
+	}
+
+	names := make([]string, 0, len(confvars))
+	for res := range confvars {
+		names = append(names, res)
+	}
+	sort.Strings(names)
+	for _, res := range names {
+		if s, ok := get(res); ok {
+			if err := xrmset(res, s); err != nil {
+				errs = append(errs, fmt.Errorf("%s.%s: %v", name, res, err))
+			}
+		}
+	}
+	for i := 0; i < max(len(colorname), 256); i++ {
+		if s, ok := get(fmt.Sprintf("color%d", i)); ok {
+			for len(colorname) <= i {
+				colorname = append(colorname, "")
+			}
+			colorname[i] = s
+		}
+	}
+
+	defaults := []struct {
+		res string
+		p   *uint32
+	}{
+		{"foreground", &defaultfg},
+		{"background", &defaultbg},
+		{"cursorColor", &defaultcs},
+		{"reverseCursor", &defaultrcs},
+	}
+	for _, d := range defaults {
+		if s, ok := get(d.res); ok {
+			xrmdefaultcolor(d.p, s)
+		}
+	}
+	return errs
+}
+
+// xrmdefaultcolor sets a default color in a slot of its own past the 256
+// colors, so that setting the foreground leaves color 7 alone
+func xrmdefaultcolor(p *uint32, s string) {
+	if *p < 256 {
+		*p = uint32(max(len(colorname), 256))
+	}
+	for len(colorname) <= int(*p) {
+		colorname = append(colorname, "")
+	}
+	colorname[*p] = s
+}
+
+// xrmset sets the setting res of the config file from the string s
+func xrmset(res, s string) error {
+	var v interface{} = s
+	switch confvars[res].(type) {
+	case *int, *uint32, *ConfRate:
+		i, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return fmt.Errorf("want an integer")
+		}
+		v = i
+	case *float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("want a number")
+		}
+		v = f
+	case *bool:
+		switch strings.ToLower(s) {
+		case "true", "on", "yes", "1":
+			v = true
+		case "false", "off", "no", "0":
+			v = false
+		default:
+			return fmt.Errorf("want true or false")
+		}
+	case *time.Duration:
+		if ms, err := strconv.Atoi(s); err == nil {
+			v = (time.Duration(ms) * time.Millisecond).String()
+		}
+	case *[]string:
+		return fmt.Errorf("only set in the config file")
+	}
+	return confvarset(res, v)
+}